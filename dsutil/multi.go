@@ -0,0 +1,59 @@
+package dsutil
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"reflect"
+)
+
+// MaxGetMulti is the largest number of keys to pass to a single
+// datastore.GetMulti call.
+const MaxGetMulti = 1000
+
+// GetMulti is a wrapper around datastore.GetMulti that reads the keys in
+// batches of MaxGetMulti, so any number of keys can be read. As with
+// datastore.GetMulti, dst must be a slice with the same length as keys and
+// the error is an appengine.MultiError (for all of the keys) if any of them
+// failed.
+func GetMulti(ctx appengine.Context, keys []*datastore.Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if len(keys) <= MaxGetMulti || v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return datastore.GetMulti(ctx, keys, dst) // which reports any problems
+	}
+
+	var errs appengine.MultiError
+	for i := 0; i < len(keys); i += MaxGetMulti {
+		j := i + MaxGetMulti
+		if j > len(keys) {
+			j = len(keys)
+		}
+
+		err := datastore.GetMulti(ctx, keys[i:j], v.Slice(i, j).Interface())
+		if me, ok := err.(appengine.MultiError); ok {
+			if errs == nil {
+				errs = make(appengine.MultiError, len(keys))
+			}
+			copy(errs[i:j], me)
+		} else if err != nil {
+			return err
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// IgnoreMissing filters datastore.ErrNoSuchEntity out of the result of a
+// GetMulti call, leaving the missing entities as zero values.
+func IgnoreMissing(err error) error {
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, e := range me {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"strconv"
+	"time"
+)
+
+// BufferedCounter is a Counter whose increments are collected in memcache
+// and written to a single random shard in one transaction once enough of
+// them have built up (or the oldest one is old enough).
+//
+// Pending increments are claimed with a compare-and-swap before they are
+// written, so concurrent flushes never write the same increments twice, and
+// claimed increments are only returned to memcache if the write definitely
+// failed. The trade-off is that pending increments can be lost:
+//
+//   - If memcache evicts the pending count, all increments since the last
+//     flush are lost. This is normally less than threshold increments.
+//   - If a flush dies after claiming the pending count (or its commit fails in
+//     a way that leaves it unknown if the transaction was applied), the
+//     claimed increments (again normally less than threshold) are lost.
+//
+// Negative increments are not buffered and are written directly.
+type BufferedCounter struct {
+	c         Counter
+	threshold uint64
+	maxAge    time.Duration
+}
+
+// NewBufferedCounter creates a new BufferedCounter with the given name that
+// spreads writes over at least `count` shards. Pending increments are
+// written to the datastore once there are at least `threshold` of them or
+// the oldest one was made more than `maxAge` ago (if maxAge is positive).
+func NewBufferedCounter(name string, count int, threshold int64, maxAge time.Duration) BufferedCounter {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return BufferedCounter{NewCounter(name, count), uint64(threshold), maxAge}
+}
+
+// Counter returns the underlying Counter (which only includes the increments
+// that have been flushed).
+func (b BufferedCounter) Counter() Counter {
+	return b.c
+}
+
+// Memcache keys for the pending count and the marker for its age.
+func (b BufferedCounter) pendingKey() string {
+	return "sharded:" + b.c.s.name + ":buf"
+}
+
+func (b BufferedCounter) ageKey() string {
+	return "sharded:" + b.c.s.name + ":bufage"
+}
+
+// Increment adds one to the counter.
+func (b BufferedCounter) Increment(ctx appengine.Context) error {
+	return b.IncrementBy(ctx, 1)
+}
+
+// IncrementBy adds delta to the counter. Positive values are buffered in
+// memcache (and flushed if needed), others are written directly. Once a
+// positive delta is buffered no error is returned, even if the flush fails.
+func (b BufferedCounter) IncrementBy(ctx appengine.Context, delta int64) error {
+	if delta <= 0 {
+		if delta == 0 {
+			return nil
+		}
+		return b.c.IncrementBy(ctx, delta)
+	}
+
+	pending, err := memcache.Increment(ctx, b.pendingKey(), delta, 0)
+	if err != nil {
+		// Don't lose the increment if memcache isn't working
+		ctx.Warningf("sharded: memcache.Increment: %v", err)
+		return b.c.IncrementBy(ctx, delta)
+	}
+
+	// Flush once there are enough pending increments or the oldest one is
+	// too old. The first pending increment starts the clock by adding an age
+	// marker that expires after maxAge, so a missing marker means it's time.
+	due := pending >= b.threshold
+	if !due && b.maxAge > 0 {
+		if pending == uint64(delta) {
+			err := memcache.Add(ctx, &memcache.Item{
+				Key:        b.ageKey(),
+				Value:      []byte{},
+				Expiration: b.maxAge,
+			})
+			if err != nil && err != memcache.ErrNotStored {
+				ctx.Warningf("sharded: memcache.Add: %v", err)
+			}
+		} else if _, err := memcache.Get(ctx, b.ageKey()); err == memcache.ErrCacheMiss {
+			due = true
+		}
+	}
+
+	// The increment is recorded either way, so a failed flush is only logged
+	// (a caller retrying the increment would count it twice). The claimed
+	// increments are returned when possible, so a later flush tries again.
+	if due {
+		if err := b.Flush(ctx); err != nil {
+			ctx.Warningf("sharded: flushing %q: %v", b.c.s.name, err)
+		}
+	}
+	return nil
+}
+
+// Flush writes any pending increments to the datastore.
+func (b BufferedCounter) Flush(ctx appengine.Context) error {
+	// Claim the pending count by swapping it with zero
+	var pending uint64
+	for {
+		item, err := memcache.Get(ctx, b.pendingKey())
+		if err == memcache.ErrCacheMiss {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		pending, err = strconv.ParseUint(string(item.Value), 10, 64)
+		if err != nil || pending == 0 {
+			return nil
+		}
+
+		item.Value = []byte("0")
+		if err = memcache.CompareAndSwap(ctx, item); err == nil {
+			break
+		} else if err == memcache.ErrNotStored {
+			return nil // evicted or deleted
+		} else if err != memcache.ErrCASConflict {
+			return err
+		}
+		// changed since we read it, so try again
+	}
+	memcache.Delete(ctx, b.ageKey())
+
+	// Write the claimed count, keeping track of whether the transaction got
+	// as far as trying to commit
+	committing := false
+	err := b.c.s.UpdateRand(ctx, func(ctx appengine.Context, key *datastore.Key) error {
+		committing = false
+		if err := addCounter(ctx, counterKey(ctx, key), int64(pending)); err != nil {
+			return err
+		}
+		committing = true
+		return nil
+	})
+
+	if err != nil {
+		if !committing || err == datastore.ErrConcurrentTransaction {
+			// Definitely not written, so return the claimed count
+			if _, e := memcache.Increment(ctx, b.pendingKey(), int64(pending), 0); e != nil {
+				ctx.Errorf("sharded: %q: lost %d increments: %v", b.c.s.name, pending, e)
+			}
+		} else {
+			ctx.Errorf("sharded: %q: %d increments may have been lost: %v", b.c.s.name, pending, err)
+		}
+	}
+	return err
+}
+
+// Value returns the current value of the counter including any pending
+// increments.
+func (b BufferedCounter) Value(ctx appengine.Context) (int64, error) {
+	value, err := b.c.Value(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if item, err := memcache.Get(ctx, b.pendingKey()); err == nil {
+		pending, _ := strconv.ParseUint(string(item.Value), 10, 64)
+		value += int64(pending)
+	} else if err != memcache.ErrCacheMiss {
+		ctx.Warningf("sharded: memcache.Get: %v", err)
+	}
+	return value, nil
+}
+
+// Reset sets the counter back to zero, discarding any pending increments
+// (see Counter.Reset).
+func (b BufferedCounter) Reset(ctx appengine.Context) error {
+	if err := memcache.Delete(ctx, b.pendingKey()); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return b.c.Reset(ctx)
+}
@@ -0,0 +1,115 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"appengine_internal"
+	"sync"
+	"time"
+
+	. "github.com/chippydip/gaege/testing"
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *ShardedSuite) TestBufferedCounter_threshold(c *C) {
+	b := NewBufferedCounter("Test", 3, 5, 0)
+	for i := 0; i < 4; i++ {
+		c.Assert(b.Increment(ctx), IsNil)
+	}
+	ctx.checkBuffered(c, b, 0, 4)
+
+	c.Assert(b.Increment(ctx), IsNil)
+	ctx.checkBuffered(c, b, 5, 5)
+
+	c.Assert(b.IncrementBy(ctx, 2), IsNil)
+	c.Assert(b.IncrementBy(ctx, -1), IsNil) // written directly
+	ctx.checkBuffered(c, b, 4, 6)
+
+	c.Assert(b.Flush(ctx), IsNil)
+	ctx.checkBuffered(c, b, 6, 6)
+	c.Assert(b.Flush(ctx), IsNil) // nothing left to write
+	ctx.checkBuffered(c, b, 6, 6)
+}
+
+// Check the value of a buffered counter (stored and including pending).
+func (ctx *ShardedSuite) checkBuffered(c *C, b BufferedCounter, stored, total int64) {
+	value, err := b.Counter().Value(ctx)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, stored)
+
+	value, err = b.Value(ctx)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, total)
+}
+
+func (ctx *ShardedSuite) TestBufferedCounter_maxAge(c *C) {
+	b := NewBufferedCounter("Test", 3, 100, time.Minute)
+	c.Assert(b.Increment(ctx), IsNil)
+	c.Assert(b.Increment(ctx), IsNil)
+	ctx.checkBuffered(c, b, 0, 2)
+
+	// The age marker expires after maxAge
+	c.Assert(memcache.Delete(ctx, b.ageKey()), IsNil)
+	c.Assert(b.Increment(ctx), IsNil)
+	ctx.checkBuffered(c, b, 3, 3)
+
+	// The next increment starts the clock again
+	c.Assert(b.Increment(ctx), IsNil)
+	ctx.checkBuffered(c, b, 3, 4)
+}
+
+// A context that can be shared by several goroutines (the calls are still
+// made one at a time, but operations using them are interleaved).
+type lockedContext struct {
+	appengine.Context
+	mu *sync.Mutex
+}
+
+func (lc lockedContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.Context.Call(service, method, in, out, opts)
+}
+
+func (ctx *ShardedSuite) TestBufferedCounter_concurrent(c *C) {
+	b := NewBufferedCounter("Test", 3, 3, 0)
+	lc := lockedContext{ctx, new(sync.Mutex)}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				c.Check(b.Increment(lc), IsNil)
+				c.Check(b.Flush(lc), IsNil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every increment was written exactly once
+	c.Assert(b.Flush(ctx), IsNil)
+	ctx.checkBuffered(c, b, 25, 25)
+}
+
+func (ctx *ShardedSuite) TestBufferedCounter_failedFlush(c *C) {
+	b := NewBufferedCounter("Test", 3, 2, 0)
+	c.Assert(b.Increment(ctx), IsNil)
+
+	// Break the config so the flush fails before writing anything
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("ShardConfig", "Test"),
+		"Count":   int64(5),
+		"Max":     int64(2),
+	})
+	c.Check(b.Increment(ctx), IsNil) // already recorded, so no error
+	c.Check(b.Flush(ctx), Equals, ErrInvalidConfig)
+
+	item, err := memcache.Get(ctx, b.pendingKey())
+	c.Assert(err, IsNil)
+	c.Check(string(item.Value), Equals, "2") // returned for a later flush
+
+	c.Assert(b.Counter().Sharded().Repair(ctx), IsNil)
+	c.Assert(b.Flush(ctx), IsNil)
+	ctx.checkBuffered(c, b, 2, 2)
+}
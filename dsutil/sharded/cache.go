@@ -0,0 +1,137 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"time"
+)
+
+// How long a config may be cached in memcache. Changes are invalidated
+// explicitly, so this only limits how long an evicted entry takes up space.
+const kConfigCacheExpiration = time.Minute
+
+// A config cached in memcache, along with the version of the cache it was
+// read at (see uncache).
+type cacheItem struct {
+	Version uint64
+	Config  shardConfig
+}
+
+// Memcache key for the cached config.
+func (s Sharded) cacheKey() string {
+	return "sharded:" + s.name + ":cfg"
+}
+
+// Memcache key for the version of the cached config.
+func (s Sharded) versionKey() string {
+	return "sharded:" + s.name + ":ver"
+}
+
+// Get the current version of the cached config, or zero if memcache is not
+// available. A missing version is started from the current time, so it won't
+// match any item cached under a version that has since been evicted.
+func (s Sharded) cacheVersion(ctx appengine.Context) uint64 {
+	version, err := memcache.Increment(ctx, s.versionKey(), 0, uint64(time.Now().UnixNano()))
+	if err != nil {
+		ctx.Warningf("sharded: memcache.Increment: %v", err)
+		return 0
+	}
+	return version
+}
+
+// Get the stored config and the version of the cache it was read at, checking
+// memcache before falling back to the datastore. A missing config is returned
+// as the zero value, so callers still need to apply clamp to get the Count to
+// use.
+//
+// The version is read before the datastore, so a config that is read while it
+// is being changed is cached under a version that is already out of date and
+// can't replace the new config.
+func (s Sharded) cachedConfig(ctx appengine.Context) (cfg shardConfig, version uint64, err error) {
+	version = s.cacheVersion(ctx)
+	if version != 0 {
+		var item cacheItem
+		_, err := memcache.Gob.Get(ctx, s.cacheKey(), &item)
+		if err == nil && item.Version == version {
+			return item.Config, version, nil
+		} else if err != nil && err != memcache.ErrCacheMiss {
+			ctx.Warningf("sharded: memcache.Get: %v", err)
+		}
+	}
+
+	// Read the stored config (treating a missing one as the zero config)
+	if err = datastore.Get(ctx, s.cfgKey(ctx), &cfg); err != nil && err != datastore.ErrNoSuchEntity {
+		return cfg, version, err
+	}
+	if version != 0 {
+		err = memcache.Gob.Set(ctx, &memcache.Item{
+			Key:        s.cacheKey(),
+			Object:     cacheItem{version, cfg},
+			Expiration: kConfigCacheExpiration,
+		})
+		if err != nil {
+			ctx.Warningf("sharded: memcache.Set: %v", err)
+		}
+	}
+	return cfg, version, nil
+}
+
+// Invalidate any cached copies of the config by moving to a new version. This
+// is called whenever the config is written and should also be called again
+// once the write is committed.
+func (s Sharded) uncache(ctx appengine.Context) error {
+	_, err := memcache.Increment(ctx, s.versionKey(), 1, uint64(time.Now().UnixNano()))
+	if err != nil {
+		ctx.Warningf("sharded: memcache.Increment: %v", err)
+	}
+	return err
+}
+
+//////////////////////////////////////////////////////////////////////////////
+
+// Entity kind used to mark shards that were merged by Vacuum.
+const kRetiredKind = "ShardRetired"
+
+// Create the key of the retired marker for the given shard.
+func retiredKey(ctx appengine.Context, shard *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, kRetiredKind, "", 1, shard)
+}
+
+// Mark a shard as retired. Must be called in the same transaction that
+// lowers Max below the shard's index. Vacuum removes the marker again once no
+// cached config can still select the shard (see pick).
+func retire(ctx appengine.Context, shard *datastore.Key) error {
+	_, err := datastore.Put(ctx, retiredKey(ctx, shard), &struct{}{})
+	return err
+}
+
+// Check if a shard has been marked as retired.
+func isRetired(ctx appengine.Context, shard *datastore.Key) (bool, error) {
+	err := datastore.Get(ctx, retiredKey(ctx, shard), &struct{}{})
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Remove the retired marker from a shard (if it has one).
+func unretire(ctx appengine.Context, shard *datastore.Key) error {
+	if retired, err := isRetired(ctx, shard); err != nil || !retired {
+		return err
+	}
+	return datastore.Delete(ctx, retiredKey(ctx, shard))
+}
+
+// Remove the retired markers of shards that were merged by a committed vacuum
+// step. Failures are only logged, since a marker left behind just makes pick
+// read the stored config until the shard is used again.
+func (s Sharded) unretireMerged(ctx appengine.Context, first, n int) {
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = retiredKey(ctx, s.key(ctx, first+i))
+	}
+	if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		ctx.Warningf("sharded: removing retired markers of %q: %v", s.name, err)
+	}
+}
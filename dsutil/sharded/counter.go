@@ -0,0 +1,136 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// Entity kind used to store the per-shard value of a Counter.
+const kCounterKind = "ShardCounter"
+
+func init() {
+	RegisterMerge("Counter", MergeCounter)
+}
+
+// Counter is an integer counter whose value is spread over a set of shards to
+// allow a high rate of concurrent updates.
+type Counter struct {
+	s Sharded
+}
+
+// NewCounter creates a new Counter with the given name that spreads writes
+// over at least `count` shards.
+func NewCounter(name string, count int) Counter {
+	return Counter{New(name, count)}
+}
+
+// Sharded returns the underlying Sharded object.
+func (c Counter) Sharded() Sharded {
+	return c.s
+}
+
+// Increment adds one to the counter.
+func (c Counter) Increment(ctx appengine.Context) error {
+	return c.IncrementBy(ctx, 1)
+}
+
+// IncrementBy adds delta (which may be negative) to the counter.
+func (c Counter) IncrementBy(ctx appengine.Context, delta int64) error {
+	return c.s.UpdateRand(ctx, func(ctx appengine.Context, key *datastore.Key) error {
+		return addCounter(ctx, counterKey(ctx, key), delta)
+	})
+}
+
+// Value returns the current value of the counter by summing all shards.
+func (c Counter) Value(ctx appengine.Context) (int64, error) {
+	keys, err := c.s.All(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return sumCounters(ctx, keys)
+}
+
+// Reset sets the counter back to zero by deleting all of its shards.
+//
+// NB: The shards are not deleted in a single transaction, so increments that
+// happen concurrently with a reset may or may not be included in the result.
+func (c Counter) Reset(ctx appengine.Context) error {
+	keys, err := c.s.All(ctx)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		keys[i] = counterKey(ctx, key)
+	}
+	return datastore.DeleteMulti(ctx, keys)
+}
+
+// Vacuum merges any unused shards of the counter (see Sharded.Vacuum).
+func (c Counter) Vacuum(ctx appengine.Context) error {
+	return c.s.Vacuum(ctx, MergeCounter)
+}
+
+// MergeCounter is a merge function for Sharded.Vacuum that adds the value of
+// the Counter stored in the `src` shard to the `dst` shard. It is registered
+// for use with EnqueueVacuum under the name "Counter".
+func MergeCounter(ctx appengine.Context, src, dst *datastore.Key) error {
+	srcKey := counterKey(ctx, src)
+
+	// Read the value to move (nothing to do if the shard was never written)
+	var shard counterShard
+	if err := datastore.Get(ctx, srcKey, &shard); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+
+	// Add it to the destination and remove it from the source
+	if err := addCounter(ctx, counterKey(ctx, dst), shard.Value); err != nil {
+		return err
+	}
+	return datastore.Delete(ctx, srcKey)
+}
+
+// Shard data for a Counter.
+type counterShard struct {
+	Value int64 `datastore:",noindex"`
+}
+
+// Create the key of the counter entity stored in the given shard.
+func counterKey(ctx appengine.Context, shard *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, kCounterKind, "", 1, shard)
+}
+
+// Add delta to the counter entity with the given key (creating it if needed).
+func addCounter(ctx appengine.Context, key *datastore.Key, delta int64) error {
+	var shard counterShard
+	if err := datastore.Get(ctx, key, &shard); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	shard.Value += delta
+	_, err := datastore.Put(ctx, key, &shard)
+	return err
+}
+
+// Sum the counter entities stored in the given shards. Missing entities are
+// treated as zero.
+func sumCounters(ctx appengine.Context, shards []*datastore.Key) (int64, error) {
+	keys := make([]*datastore.Key, len(shards))
+	for i, shard := range shards {
+		keys[i] = counterKey(ctx, shard)
+	}
+
+	values := make([]counterShard, len(keys))
+	if err := dsutil.IgnoreMissing(dsutil.GetMulti(ctx, keys, values)); err != nil {
+		return 0, err
+	}
+
+	var sum int64
+	for _, v := range values {
+		sum += v.Value
+	}
+	return sum, nil
+}
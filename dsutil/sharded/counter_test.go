@@ -0,0 +1,53 @@
+package sharded
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *ShardedSuite) TestCounter_Value_empty(c *C) {
+	counter := NewCounter("Test", 3)
+	value, err := counter.Value(ctx)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, int64(0))
+}
+
+func (ctx *ShardedSuite) TestCounter_Increment(c *C) {
+	counter := NewCounter("Test", 3)
+	for i := 0; i < 10; i++ {
+		c.Assert(counter.Increment(ctx), IsNil)
+	}
+	c.Assert(counter.IncrementBy(ctx, -3), IsNil)
+
+	value, err := counter.Value(ctx)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, int64(7))
+}
+
+func (ctx *ShardedSuite) TestCounter_Reset(c *C) {
+	counter := NewCounter("Test", 3)
+	c.Assert(counter.IncrementBy(ctx, 5), IsNil)
+	c.Assert(counter.Reset(ctx), IsNil)
+
+	value, err := counter.Value(ctx)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, int64(0))
+}
+
+func (ctx *ShardedSuite) TestCounter_Vacuum(c *C) {
+	counter := NewCounter("Test", 5)
+	for i := 0; i < 20; i++ {
+		c.Assert(counter.Increment(ctx), IsNil)
+	}
+
+	counter = NewCounter("Test", 1)
+	c.Assert(counter.Vacuum(ctx), IsNil)
+
+	keys, err := counter.Sharded().All(ctx)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 1)
+
+	value, err := counter.Value(ctx)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, int64(20))
+	c.Check(ctx.GetAll(c), HasLen, 2)
+}
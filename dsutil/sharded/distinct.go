@@ -0,0 +1,164 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// Entity kind used to store the per-shard sketch of a Distinct.
+const kDistinctKind = "ShardDistinct"
+
+func init() {
+	RegisterMerge("Distinct", MergeDistinct)
+}
+
+// Distinct estimates the number of distinct items (such as unique visitors)
+// added to it. Each shard stores a HyperLogLog sketch, so the size of each
+// shard's entity is bounded by the precision rather than the number of items.
+type Distinct struct {
+	s         Sharded
+	precision int
+}
+
+// NewDistinct creates a new Distinct with the given name that spreads writes
+// over at least `count` shards and uses sketches with the given precision
+// (DefaultPrecision is used if it is outside [MinPrecision, MaxPrecision]).
+//
+// The precision can be changed later, but existing shards keep the precision
+// they were created with and reads use the lowest precision of all shards.
+func NewDistinct(name string, count, precision int) Distinct {
+	if precision < MinPrecision || precision > MaxPrecision {
+		precision = DefaultPrecision
+	}
+	return Distinct{New(name, count), precision}
+}
+
+// Sharded returns the underlying Sharded object.
+func (d Distinct) Sharded() Sharded {
+	return d.s
+}
+
+// Add adds the given items to a single randomly selected shard.
+func (d Distinct) Add(ctx appengine.Context, items ...string) error {
+	if len(items) == 0 {
+		return nil
+	}
+	return d.s.UpdateRand(ctx, func(ctx appengine.Context, key *datastore.Key) error {
+		key = distinctKey(ctx, key)
+		h, err := getSketch(ctx, key)
+		if err == datastore.ErrNoSuchEntity {
+			h = NewHyperLogLog(d.precision)
+		} else if err != nil {
+			return err
+		}
+
+		changed := false
+		for _, item := range items {
+			if h.Add(item) {
+				changed = true
+			}
+		}
+
+		// Most adds of known items don't change the sketch
+		if !changed {
+			return nil
+		}
+		return putSketch(ctx, key, h)
+	})
+}
+
+// Sketch returns the union of the sketches from all shards.
+func (d Distinct) Sketch(ctx appengine.Context) (*HyperLogLog, error) {
+	shards, err := d.s.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*datastore.Key, len(shards))
+	for i, shard := range shards {
+		keys[i] = distinctKey(ctx, shard)
+	}
+
+	values := make([]distinctShard, len(keys))
+	if err := dsutil.IgnoreMissing(dsutil.GetMulti(ctx, keys, values)); err != nil {
+		return nil, err
+	}
+
+	sum := NewHyperLogLog(d.precision)
+	for _, v := range values {
+		if v.Registers == nil {
+			continue // shard was never written
+		}
+		h, err := loadHyperLogLog(v.Registers)
+		if err != nil {
+			return nil, err
+		}
+		sum.Merge(h)
+	}
+	return sum, nil
+}
+
+// Count returns the estimated number of distinct items that have been added.
+func (d Distinct) Count(ctx appengine.Context) (uint64, error) {
+	h, err := d.Sketch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return h.Count(), nil
+}
+
+// Vacuum merges any unused shards (see Sharded.Vacuum).
+func (d Distinct) Vacuum(ctx appengine.Context) error {
+	return d.s.Vacuum(ctx, MergeDistinct)
+}
+
+// MergeDistinct is a merge function for Sharded.Vacuum that merges the
+// sketch of a Distinct stored in the `src` shard into the `dst` shard. It is
+// registered for use with EnqueueVacuum under the name "Distinct".
+func MergeDistinct(ctx appengine.Context, src, dst *datastore.Key) error {
+	srcKey, dstKey := distinctKey(ctx, src), distinctKey(ctx, dst)
+
+	// Read the sketch to move (nothing to do if the shard was never written)
+	h, err := getSketch(ctx, srcKey)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Union it with the destination and remove it from the source
+	if other, err := getSketch(ctx, dstKey); err == nil {
+		h.Merge(other)
+	} else if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if err := putSketch(ctx, dstKey, h); err != nil {
+		return err
+	}
+	return datastore.Delete(ctx, srcKey)
+}
+
+// Shard data for a Distinct.
+type distinctShard struct {
+	Registers []byte `datastore:",noindex"`
+}
+
+// Create the key of the sketch entity stored in the given shard.
+func distinctKey(ctx appengine.Context, shard *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, kDistinctKind, "", 1, shard)
+}
+
+func getSketch(ctx appengine.Context, key *datastore.Key) (*HyperLogLog, error) {
+	var shard distinctShard
+	if err := datastore.Get(ctx, key, &shard); err != nil {
+		return nil, err
+	}
+	return loadHyperLogLog(shard.Registers)
+}
+
+func putSketch(ctx appengine.Context, key *datastore.Key, h *HyperLogLog) error {
+	_, err := datastore.Put(ctx, key, &distinctShard{h.Bytes()})
+	return err
+}
@@ -0,0 +1,91 @@
+package sharded
+
+import (
+	"hash/fnv"
+)
+
+// Hash an item name for use with jumpHash.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// Jump consistent hash (Lamping and Veach, http://arxiv.org/abs/1406.2294).
+// Maps key to a bucket in [0, n).
+func jumpHash(key uint64, n int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// Return every bucket that jumpHash assigns key to for any n in [1, max]
+// (in increasing order). There are about ln(max) of them.
+func jumpBuckets(key uint64, max int) []int {
+	var buckets []int
+	b, j := int64(-1), int64(0)
+	for j < int64(max) {
+		b = j
+		buckets = append(buckets, int(b))
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return buckets
+}
+
+// Return the next lower shard on the chain of shard i (> 1). The chain of each
+// shard only depends on its index, so the shards that its data may have been
+// merged into can be recomputed later (see vacuumTarget and locate).
+func mergeTarget(i int) int {
+	return jumpHash(mix64(uint64(i)), i-1) + 1
+}
+
+// Return the shard that Vacuum merges shard i into when Count is `count`: the
+// first shard in [1, count] on the chain of i. Since that shard is still in
+// use, data is never merged twice by the same vacuum run.
+func vacuumTarget(i, count int) int {
+	for i > count {
+		i = mergeTarget(i)
+	}
+	return i
+}
+
+// Return the indexes of all shards that may contain data written for an item
+// with hash h (see Sharded.Locate). Data written to shard i is moved along
+// the chain of i by each Vacuum, but never past the first shard that is not
+// above Floor, the lowest Count any Vacuum has merged down to.
+func locate(h uint64, cfg shardConfig) []int {
+	peak := cfg.Peak
+	if peak < cfg.Max {
+		peak = cfg.Max
+	}
+
+	// Start with the current shard and then add every shard the item has
+	// been assigned to for smaller or larger counts
+	indexes := []int{jumpHash(h, cfg.Count) + 1}
+	seen := map[int]bool{indexes[0]: true}
+	for _, b := range jumpBuckets(h, peak) {
+		for i := b + 1; ; i = mergeTarget(i) {
+			if i <= cfg.Max && !seen[i] {
+				seen[i] = true
+				indexes = append(indexes, i)
+			}
+			if cfg.Floor == 0 || i <= cfg.Floor {
+				break
+			}
+		}
+	}
+	return indexes
+}
+
+// Scramble the bits of an integer (the splitmix64 finalizer).
+func mix64(z uint64) uint64 {
+	z *= 0x9e3779b97f4a7c15
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
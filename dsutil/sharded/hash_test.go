@@ -0,0 +1,158 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *ShardedSuite) TestJumpHash_moves(c *C) {
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		h := hashString(fmt.Sprint(i))
+		a, b := jumpHash(h, 10), jumpHash(h, 11)
+		c.Assert(a >= 0 && a < 10, Equals, true)
+		if a != b {
+			c.Check(b, Equals, 10) // only moves to the new bucket
+			moved++
+		}
+	}
+	c.Check(moved > 50 && moved < 150, Equals, true, Commentf("moved %d", moved))
+}
+
+func (ctx *ShardedSuite) TestMergeTarget_lower(c *C) {
+	for i := 2; i < 1000; i++ {
+		j := mergeTarget(i)
+		c.Assert(j >= 1 && j < i, Equals, true, Commentf("mergeTarget(%d) = %d", i, j))
+	}
+}
+
+func (ctx *ShardedSuite) TestLocate_model(c *C) {
+	// Change Count (vacuuming after some of the changes) and write every item
+	// after each change, tracking which shards hold data for each item
+	steps := []struct {
+		count  int
+		vacuum bool
+	}{{3, false}, {8, false}, {5, false}, {2, true}, {5, false}, {12, false},
+		{4, true}, {6, false}, {1, false}, {3, true}, {9, false}, {7, true}}
+
+	var cfg shardConfig
+	shards := map[int]map[string]bool{}
+	add := func(i int, item string) {
+		if shards[i] == nil {
+			shards[i] = map[string]bool{}
+		}
+		shards[i][item] = true
+	}
+	for _, step := range steps {
+		cfg.setCount(step.count)
+		if step.vacuum {
+			for ; cfg.Max > cfg.Count; cfg.Max-- {
+				j := vacuumTarget(cfg.Max, cfg.Count)
+				for item := range shards[cfg.Max] {
+					add(j, item)
+				}
+				delete(shards, cfg.Max)
+			}
+			if cfg.Floor == 0 || cfg.Count < cfg.Floor {
+				cfg.Floor = cfg.Count
+			}
+		}
+
+		for n := 0; n < 1000; n++ {
+			item := fmt.Sprint(n)
+			add(jumpHash(hashString(item), cfg.Count)+1, item)
+		}
+
+		for i, items := range shards {
+			for item := range items {
+				located := false
+				for _, j := range locate(hashString(item), cfg) {
+					located = located || i == j
+				}
+				c.Assert(located, Equals, true, Commentf("item %q in shard %d, config %+v", item, i, cfg))
+			}
+		}
+	}
+}
+
+// Per-item counters stored as children of the shard keys
+func itemKey(ctx appengine.Context, shard *datastore.Key, item string) *datastore.Key {
+	return datastore.NewKey(ctx, "TestItem", item, 0, shard)
+}
+
+func mergeItems(ctx appengine.Context, src, dst *datastore.Key) error {
+	var values []counterShard
+	keys, err := datastore.NewQuery("TestItem").Ancestor(src).GetAll(ctx, &values)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if err := addCounter(ctx, itemKey(ctx, dst, key.StringID()), values[i].Value); err != nil {
+			return err
+		}
+	}
+	return datastore.DeleteMulti(ctx, keys)
+}
+
+var testItems = []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+// Write each item once with each of the given counts.
+func (ctx *ShardedSuite) writeItems(c *C, counts ...int) {
+	for _, count := range counts {
+		s := New("Test", count)
+		for _, item := range testItems {
+			item := item
+			err := s.UpdateFor(ctx, item, func(ctx appengine.Context, key *datastore.Key) error {
+				return addCounter(ctx, itemKey(ctx, key, item), 1)
+			})
+			c.Assert(err, IsNil)
+		}
+	}
+}
+
+// Check that every write is found in the located shards.
+func (ctx *ShardedSuite) checkLocated(c *C, s Sharded, writes int64) {
+	for _, item := range testItems {
+		keys, err := s.Locate(ctx, item)
+		c.Assert(err, IsNil)
+
+		total := int64(0)
+		for _, key := range keys {
+			var v counterShard
+			if err := datastore.Get(ctx, itemKey(ctx, key, item), &v); err != datastore.ErrNoSuchEntity {
+				c.Check(err, IsNil)
+			}
+			total += v.Value
+		}
+		c.Check(total, Equals, writes, Commentf("item %q", item))
+	}
+}
+
+func (ctx *ShardedSuite) TestSharded_Locate_afterVacuum(c *C) {
+	ctx.writeItems(c, 3, 8, 5)
+	s := New("Test", 2)
+	c.Assert(s.Vacuum(ctx, mergeItems), IsNil)
+
+	for _, item := range testItems {
+		keys, err := s.Locate(ctx, item)
+		c.Assert(err, IsNil)
+		c.Check(len(keys) <= 2, Equals, true) // only two shards are left
+	}
+	ctx.checkLocated(c, s, 3)
+}
+
+func (ctx *ShardedSuite) TestSharded_Locate_shrinkVacuumGrow(c *C) {
+	ctx.writeItems(c, 8)
+	c.Assert(New("Test", 2).Vacuum(ctx, mergeItems), IsNil)
+
+	// Data merged into the first two shards must still be found after growing
+	ctx.writeItems(c, 5)
+	ctx.checkLocated(c, New("Test", 5), 2)
+
+	c.Assert(New("Test", 3).Vacuum(ctx, mergeItems), IsNil)
+	ctx.writeItems(c, 6)
+	ctx.checkLocated(c, New("Test", 6), 3)
+}
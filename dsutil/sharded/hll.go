@@ -0,0 +1,166 @@
+package sharded
+
+import (
+	"errors"
+	"math"
+)
+
+const (
+	// Smallest and largest precision supported by HyperLogLog. A sketch uses
+	// 2^precision bytes, so the largest sketch is 64KB.
+	MinPrecision = 4
+	MaxPrecision = 16
+
+	// Precision used by NewDistinct if an invalid value is given, giving a
+	// standard error of about 0.8% using 16KB per shard.
+	DefaultPrecision = 14
+)
+
+var ErrInvalidSketch = errors.New("sharded: invalid HyperLogLog sketch")
+
+// HyperLogLog is a sketch that estimates the number of distinct items added
+// to it using a fixed amount of memory. The standard error of the estimate
+// is about 1.04/sqrt(2^precision).
+type HyperLogLog struct {
+	p         uint
+	registers []byte
+}
+
+// NewHyperLogLog creates an empty sketch with the given precision (which is
+// limited to [MinPrecision, MaxPrecision]).
+func NewHyperLogLog(precision int) *HyperLogLog {
+	if precision < MinPrecision {
+		precision = MinPrecision
+	} else if precision > MaxPrecision {
+		precision = MaxPrecision
+	}
+	return &HyperLogLog{
+		p:         uint(precision),
+		registers: make([]byte, 1<<uint(precision)),
+	}
+}
+
+// Load a sketch from its registers (as returned by Bytes).
+func loadHyperLogLog(registers []byte) (*HyperLogLog, error) {
+	for p := uint(MinPrecision); p <= MaxPrecision; p++ {
+		if len(registers) == 1<<p {
+			return &HyperLogLog{p, registers}, nil
+		}
+	}
+	return nil, ErrInvalidSketch
+}
+
+// Precision returns the precision of the sketch.
+func (h *HyperLogLog) Precision() int {
+	return int(h.p)
+}
+
+// Bytes returns the registers of the sketch (one byte each).
+func (h *HyperLogLog) Bytes() []byte {
+	return h.registers
+}
+
+// Add adds an item to the sketch and reports whether the sketch changed.
+func (h *HyperLogLog) Add(item string) bool {
+	x := mix64(hashString(item))
+
+	// The first p bits select the register and the rest provide the rank
+	i := x >> (64 - h.p)
+	rank := byte(leadingZeros(x<<h.p, 64-h.p) + 1)
+
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+		return true
+	}
+	return false
+}
+
+// Merge adds all items from other to the sketch (the result estimates the
+// size of the union). If the precisions differ, the result has the lower of
+// the two.
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	if other.p < h.p {
+		h.reduce(other.p)
+	} else if other.p > h.p {
+		other = other.copy()
+		other.reduce(h.p)
+	}
+
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// Count returns the estimated number of distinct items added to the sketch.
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	estimate := alpha * m * m / sum
+
+	// Use linear counting for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+func (h *HyperLogLog) copy() *HyperLogLog {
+	registers := make([]byte, len(h.registers))
+	copy(registers, h.registers)
+	return &HyperLogLog{h.p, registers}
+}
+
+// Lower the precision of the sketch to p (which must not be larger than the
+// current precision).
+func (h *HyperLogLog) reduce(p uint) {
+	shift := h.p - p
+	registers := make([]byte, 1<<p)
+	for i, r := range h.registers {
+		if r == 0 {
+			continue
+		}
+
+		// The low bits of the old index become the first bits of the rank
+		rank := byte(shift) + r
+		if low := uint64(i) & (1<<shift - 1); low != 0 {
+			rank = byte(leadingZeros(low<<(64-shift), shift) + 1)
+		}
+
+		j := i >> shift
+		if rank > registers[j] {
+			registers[j] = rank
+		}
+	}
+	h.p, h.registers = p, registers
+}
+
+// Count the leading zero bits of x, considering only the first n bits.
+func leadingZeros(x uint64, n uint) uint {
+	z := uint(0)
+	for z < n && x&(1<<63) == 0 {
+		x <<= 1
+		z++
+	}
+	return z
+}
@@ -0,0 +1,67 @@
+package sharded
+
+import (
+	"fmt"
+
+	. "launchpad.net/gocheck"
+)
+
+// Check that an estimate is within the given relative error of n.
+func checkEstimate(c *C, estimate uint64, n int, tolerance float64) {
+	diff := float64(estimate) - float64(n)
+	if diff < 0 {
+		diff = -diff
+	}
+	c.Check(diff <= tolerance*float64(n), Equals, true, Commentf("estimate %d for %d items", estimate, n))
+}
+
+func (ctx *ShardedSuite) TestHyperLogLog_Count(c *C) {
+	for _, n := range []int{0, 10, 1000, 100000} {
+		h := NewHyperLogLog(14)
+		for i := 0; i < n; i++ {
+			h.Add(fmt.Sprint(i))
+			h.Add(fmt.Sprint(i)) // duplicates are ignored
+		}
+		checkEstimate(c, h.Count(), n, 0.03)
+	}
+}
+
+func (ctx *ShardedSuite) TestHyperLogLog_Merge(c *C) {
+	a, b := NewHyperLogLog(12), NewHyperLogLog(12)
+	for i := 0; i < 6000; i++ {
+		a.Add(fmt.Sprint(i))
+		b.Add(fmt.Sprint(i + 4000))
+	}
+	a.Merge(b)
+	checkEstimate(c, a.Count(), 10000, 0.05)
+}
+
+func (ctx *ShardedSuite) TestHyperLogLog_Merge_precision(c *C) {
+	// Merging into a lower precision must give the same result as adding the
+	// items at that precision directly
+	low, high, direct := NewHyperLogLog(8), NewHyperLogLog(14), NewHyperLogLog(8)
+	for i := 0; i < 5000; i++ {
+		high.Add(fmt.Sprint(i))
+		direct.Add(fmt.Sprint(i))
+	}
+	low.Merge(high)
+	c.Check(low.Precision(), Equals, 8)
+	c.Check(low.Bytes(), DeepEquals, direct.Bytes())
+	c.Check(high.Precision(), Equals, 14) // unchanged
+}
+
+func (ctx *ShardedSuite) TestDistinct_Count(c *C) {
+	d := NewDistinct("Test", 4, 10)
+	for i := 0; i < 50; i++ {
+		c.Assert(d.Add(ctx, fmt.Sprint(i), fmt.Sprint(i%10)), IsNil)
+	}
+
+	count, err := d.Count(ctx)
+	c.Check(err, IsNil)
+	checkEstimate(c, count, 50, 0.1)
+
+	c.Assert(NewDistinct("Test", 1, 10).Vacuum(ctx), IsNil)
+	after, err := d.Count(ctx)
+	c.Check(err, IsNil)
+	c.Check(after, Equals, count) // union doesn't change the estimate
+}
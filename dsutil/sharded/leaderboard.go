@@ -0,0 +1,324 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// Entity kind used to store the per-shard list of a Leaderboard.
+const kLeaderboardKind = "ShardLeaderboard"
+
+// Appended to the name of a Leaderboard to get the kind used to store the
+// latest entry of each member.
+const kLeaderboardMemberSuffix = "Member"
+
+func init() {
+	RegisterMerge("Leaderboard", MergeLeaderboard)
+}
+
+// ErrNotRanked is returned by Leaderboard.Rank for members that are not in
+// the top entries of the leaderboard.
+var ErrNotRanked = errors.New("sharded: member is not ranked")
+
+// Leaderboard keeps track of the members with the highest scores. Each shard
+// stores a bounded list of its highest scoring members and reads merge these
+// lists.
+//
+// Members are assigned to shards with Sharded.For, so a member normally only
+// has a single entry. If Count changes, a member may end up with entries in
+// more than one shard. The latest entry of each member is therefore also
+// stored in an entity of its own (keyed by the member), and list entries that
+// are older are ignored by reads and dropped by the next write to their list.
+type Leaderboard struct {
+	s    Sharded
+	size int
+}
+
+// Entry is a single member of a Leaderboard.
+type Entry struct {
+	Member  string
+	Score   int64
+	Updated time.Time
+}
+
+// NewLeaderboard creates a new Leaderboard with the given name that spreads
+// writes over at least `count` shards and keeps track of the `size` highest
+// scoring members.
+func NewLeaderboard(name string, count, size int) Leaderboard {
+	if size < 1 {
+		size = 1
+	}
+	return Leaderboard{New(name, count), size}
+}
+
+// Sharded returns the underlying Sharded object.
+func (l Leaderboard) Sharded() Sharded {
+	return l.s
+}
+
+// Set sets the score of a member (replacing any previous score).
+func (l Leaderboard) Set(ctx appengine.Context, member string, score int64) error {
+	if member == "" {
+		return datastore.ErrInvalidKey
+	}
+	return l.s.UpdateFor(ctx, member, func(tc appengine.Context, key *datastore.Key) error {
+		entry := Entry{member, score, time.Now()}
+		memberKey := leaderboardMemberKey(tc, l.s.name, member)
+		if _, err := datastore.Put(tc, memberKey, &leaderboardMember{score, entry.Updated}); err != nil {
+			return err
+		}
+
+		key = leaderboardKey(tc, key)
+		shard, err := getLeaderboard(tc, key)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		// Replace the member's entry, drop entries of members that have
+		// since been set in other shards and trim the list. Entries only ever
+		// become outdated, so the members can be read outside the transaction
+		// (which keeps the number of entity groups it uses down).
+		var entries []Entry
+		for _, e := range shard.entries() {
+			if e.Member != member {
+				entries = append(entries, e)
+			}
+		}
+		if entries, err = currentEntries(ctx, l.s.name, entries); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		sort.Sort(byRank(entries))
+		if len(entries) > l.size {
+			entries = entries[:l.size]
+		}
+
+		return putLeaderboard(tc, key, newLeaderboardShard(entries, l.size))
+	})
+}
+
+// Top returns the (up to) n highest scoring members, highest first. Members
+// with the same score are ordered by the time they reached it.
+func (l Leaderboard) Top(ctx appengine.Context, n int) ([]Entry, error) {
+	entries, err := l.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if n >= 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries, nil
+}
+
+// Rank returns the rank of a member (starting at 1) and its entry, or
+// ErrNotRanked if it isn't one of the highest scoring members.
+func (l Leaderboard) Rank(ctx appengine.Context, member string) (int, Entry, error) {
+	entries, err := l.all(ctx)
+	if err != nil {
+		return 0, Entry{}, err
+	}
+	for i, e := range entries {
+		if e.Member == member {
+			return i + 1, e, nil
+		}
+	}
+	return 0, Entry{}, ErrNotRanked
+}
+
+// Vacuum merges any unused shards (see Sharded.Vacuum).
+func (l Leaderboard) Vacuum(ctx appengine.Context) error {
+	return l.s.Vacuum(ctx, MergeLeaderboard)
+}
+
+// Read and merge the lists from all shards.
+func (l Leaderboard) all(ctx appengine.Context) ([]Entry, error) {
+	shards, err := l.s.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*datastore.Key, len(shards))
+	for i, shard := range shards {
+		keys[i] = leaderboardKey(ctx, shard)
+	}
+
+	values := make([]leaderboardShard, len(keys))
+	if err := dsutil.IgnoreMissing(dsutil.GetMulti(ctx, keys, values)); err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, v := range values {
+		entries = append(entries, v.entries()...)
+	}
+	entries, err = currentEntries(ctx, l.s.name, mergeEntries(entries))
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > l.size {
+		entries = entries[:l.size]
+	}
+	return entries, nil
+}
+
+// MergeLeaderboard is a merge function for Sharded.Vacuum that merges the
+// list of a Leaderboard stored in the `src` shard into the `dst` shard. It is
+// registered for use with EnqueueVacuum under the name "Leaderboard".
+//
+// Outdated entries are left for reads to ignore, since checking them would
+// use an entity group for each member.
+func MergeLeaderboard(ctx appengine.Context, src, dst *datastore.Key) error {
+	srcKey, dstKey := leaderboardKey(ctx, src), leaderboardKey(ctx, dst)
+
+	// Read the list to move (nothing to do if the shard was never written)
+	shard, err := getLeaderboard(ctx, srcKey)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	entries, size := shard.entries(), shard.Size
+
+	// Merge it with the destination and remove it from the source
+	if other, err := getLeaderboard(ctx, dstKey); err == nil {
+		entries = append(entries, other.entries()...)
+		if other.Size > size {
+			size = other.Size
+		}
+	} else if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	entries = mergeEntries(entries)
+	if len(entries) > size {
+		entries = entries[:size]
+	}
+	if err := putLeaderboard(ctx, dstKey, newLeaderboardShard(entries, size)); err != nil {
+		return err
+	}
+	return datastore.Delete(ctx, srcKey)
+}
+
+// Remove the entries that are older than the latest entry stored for their
+// member (entries without a stored member are kept).
+func currentEntries(ctx appengine.Context, name string, entries []Entry) ([]Entry, error) {
+	keys := make([]*datastore.Key, len(entries))
+	for i, e := range entries {
+		keys[i] = leaderboardMemberKey(ctx, name, e.Member)
+	}
+
+	members := make([]leaderboardMember, len(keys))
+	if err := dsutil.IgnoreMissing(dsutil.GetMulti(ctx, keys, members)); err != nil {
+		return nil, err
+	}
+
+	current := entries[:0]
+	for i, e := range entries {
+		if !members[i].Updated.After(e.Updated) {
+			current = append(current, e)
+		}
+	}
+	return current, nil
+}
+
+// Keep only the most recent entry for each member and sort by rank.
+func mergeEntries(entries []Entry) []Entry {
+	latest := make(map[string]int, len(entries))
+	merged := entries[:0]
+	for _, e := range entries {
+		if i, ok := latest[e.Member]; !ok {
+			latest[e.Member] = len(merged)
+			merged = append(merged, e)
+		} else if e.Updated.After(merged[i].Updated) {
+			merged[i] = e
+		}
+	}
+	sort.Sort(byRank(merged))
+	return merged
+}
+
+// Sort entries by descending score, then by the time the score was set.
+type byRank []Entry
+
+func (a byRank) Len() int      { return len(a) }
+func (a byRank) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byRank) Less(i, j int) bool {
+	if a[i].Score != a[j].Score {
+		return a[i].Score > a[j].Score
+	}
+	if !a[i].Updated.Equal(a[j].Updated) {
+		return a[i].Updated.Before(a[j].Updated)
+	}
+	return a[i].Member < a[j].Member
+}
+
+// Shard data for a Leaderboard (stored as parallel slices in rank order).
+type leaderboardShard struct {
+	Size    int         `datastore:",noindex"`
+	Members []string    `datastore:",noindex"`
+	Scores  []int64     `datastore:",noindex"`
+	Updated []time.Time `datastore:",noindex"`
+}
+
+func newLeaderboardShard(entries []Entry, size int) *leaderboardShard {
+	shard := &leaderboardShard{
+		Size:    size,
+		Members: make([]string, len(entries)),
+		Scores:  make([]int64, len(entries)),
+		Updated: make([]time.Time, len(entries)),
+	}
+	for i, e := range entries {
+		shard.Members[i], shard.Scores[i], shard.Updated[i] = e.Member, e.Score, e.Updated
+	}
+	return shard
+}
+
+func (shard *leaderboardShard) entries() []Entry {
+	n := len(shard.Members)
+	if len(shard.Scores) < n {
+		n = len(shard.Scores)
+	}
+	if len(shard.Updated) < n {
+		n = len(shard.Updated)
+	}
+
+	entries := make([]Entry, n)
+	for i := range entries {
+		entries[i] = Entry{shard.Members[i], shard.Scores[i], shard.Updated[i]}
+	}
+	return entries
+}
+
+// Latest entry of a Leaderboard member.
+type leaderboardMember struct {
+	Score   int64     `datastore:",noindex"`
+	Updated time.Time `datastore:",noindex"`
+}
+
+// Create the key of the entity storing the latest entry of a member. Each
+// member is in an entity group of its own, so members don't contend with
+// each other or with the shards.
+func leaderboardMemberKey(ctx appengine.Context, name, member string) *datastore.Key {
+	return datastore.NewKey(ctx, name+kLeaderboardMemberSuffix, member, 0, nil)
+}
+
+// Create the key of the list entity stored in the given shard.
+func leaderboardKey(ctx appengine.Context, shard *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, kLeaderboardKind, "", 1, shard)
+}
+
+func getLeaderboard(ctx appengine.Context, key *datastore.Key) (*leaderboardShard, error) {
+	shard := new(leaderboardShard)
+	err := datastore.Get(ctx, key, shard)
+	return shard, err
+}
+
+func putLeaderboard(ctx appengine.Context, key *datastore.Key, shard *leaderboardShard) error {
+	_, err := datastore.Put(ctx, key, shard)
+	return err
+}
@@ -0,0 +1,91 @@
+package sharded
+
+import (
+	"fmt"
+
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *ShardedSuite) TestLeaderboard_Top(c *C) {
+	l := NewLeaderboard("Test", 3, 5)
+	for i := 0; i < 10; i++ {
+		c.Assert(l.Set(ctx, fmt.Sprint("m", i), int64(i*10)), IsNil)
+	}
+	c.Assert(l.Set(ctx, "m0", 1000), IsNil) // update an existing member
+
+	top, err := l.Top(ctx, 3)
+	c.Check(err, IsNil)
+	c.Assert(top, HasLen, 3)
+	c.Check(top[0].Member, Equals, "m0")
+	c.Check(top[0].Score, Equals, int64(1000))
+	c.Check(top[1].Member, Equals, "m9")
+	c.Check(top[2].Member, Equals, "m8")
+
+	top, err = l.Top(ctx, -1)
+	c.Check(err, IsNil)
+	c.Check(top, HasLen, 5)
+}
+
+func (ctx *ShardedSuite) TestLeaderboard_Rank(c *C) {
+	l := NewLeaderboard("Test", 3, 3)
+	for i := 0; i < 5; i++ {
+		c.Assert(l.Set(ctx, fmt.Sprint("m", i), int64(i)), IsNil)
+	}
+
+	rank, entry, err := l.Rank(ctx, "m3")
+	c.Check(err, IsNil)
+	c.Check(rank, Equals, 2)
+	c.Check(entry.Score, Equals, int64(3))
+
+	_, _, err = l.Rank(ctx, "m0")
+	c.Check(err, Equals, ErrNotRanked)
+}
+
+func (ctx *ShardedSuite) TestLeaderboard_Vacuum(c *C) {
+	l := NewLeaderboard("Test", 4, 10)
+	for i := 0; i < 10; i++ {
+		c.Assert(l.Set(ctx, fmt.Sprint("m", i), int64(i)), IsNil)
+	}
+	before, err := l.Top(ctx, -1)
+	c.Assert(err, IsNil)
+
+	c.Assert(NewLeaderboard("Test", 1, 10).Vacuum(ctx), IsNil)
+
+	after, err := l.Top(ctx, -1)
+	c.Check(err, IsNil)
+	c.Check(after, HasLen, 10)
+	for i := range after {
+		c.Check(after[i].Member, Equals, before[i].Member)
+	}
+}
+
+func (ctx *ShardedSuite) TestLeaderboard_Set_countChanged(c *C) {
+	// Find a member that moves to another shard when Count is raised to 4,
+	// and another member that is already in that shard
+	var member, other string
+	for i := 0; member == "" || other == ""; i++ {
+		m := fmt.Sprint("m", i)
+		switch b := jumpHash(hashString(m), 4); {
+		case member == "" && b != 0:
+			member = m
+		case member != "" && b == jumpHash(hashString(member), 4):
+			other = m
+		}
+	}
+
+	c.Assert(NewLeaderboard("Test", 1, 1).Set(ctx, member, 100), IsNil)
+
+	// The lower score doesn't make it into the new shard's list, but the
+	// old entry in the first shard must not be used either
+	l := NewLeaderboard("Test", 4, 1)
+	c.Assert(l.Set(ctx, other, 50), IsNil)
+	c.Assert(l.Set(ctx, member, 5), IsNil)
+
+	top, err := l.Top(ctx, -1)
+	c.Check(err, IsNil)
+	c.Assert(top, HasLen, 1)
+	c.Check(top[0].Member, Equals, other)
+
+	_, _, err = l.Rank(ctx, member)
+	c.Check(err, Equals, ErrNotRanked)
+}
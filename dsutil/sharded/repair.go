@@ -0,0 +1,109 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"time"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// Repair rebuilds a consistent ShardConfig entity (for example after
+// ErrInvalidConfig was returned). It scans the datastore for the highest
+// numbered shard that still contains data and then stores a config that reads
+// from at least that many shards (and never fewer than before) and writes to
+// the number of shards that s would normally use. Any extra shards can then be
+// merged with Vacuum.
+//
+// The scan uses a kindless query, so it is only eventually consistent and
+// writes that happen during the repair may not be seen.
+func (s Sharded) Repair(ctx appengine.Context) error {
+	highest, err := s.highestShard(ctx)
+	if err != nil {
+		return err
+	}
+
+	var cfg shardConfig
+	err = dsutil.RunInTransaction(ctx, func(ctx appengine.Context) error {
+		// Read the stored config (without validating it)
+		cfg = shardConfig{}
+		cfgKey := s.cfgKey(ctx)
+		if err := datastore.Get(ctx, cfgKey, &cfg); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		old := cfg
+
+		// Keep the stored Count if it is usable and read from every shard that
+		// has data. Max is never lowered, since writers using a cached config
+		// rely on Vacuum to mark shards above Max as retired (see Rand).
+		if cfg.Count < 1 {
+			cfg.Count = 0
+		}
+		if highest > cfg.Max {
+			cfg.Max = highest
+		}
+		cfg.setCount(s.clamp(cfg.Count))
+		if cfg.Count == old.Count && cfg.Max == old.Max && cfg.Peak == old.Peak {
+			return nil // nothing to fix
+		}
+
+		cfg.record(time.Now(), fmt.Sprintf("Repaired Count %d -> %d, Max %d -> %d",
+			old.Count, cfg.Count, old.Max, cfg.Max))
+		if _, err := datastore.Put(ctx, cfgKey, &cfg); err != nil {
+			return err
+		}
+		s.uncache(ctx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.uncache(ctx)
+	ctx.Infof("sharded: repaired %q (Count = %d, Max = %d)", s.name, cfg.Count, cfg.Max)
+	return nil
+}
+
+// Find the index of the highest numbered shard that contains any entities
+// (other than a retired marker) or 0 if no shards have data.
+func (s Sharded) highestShard(ctx appengine.Context) (int, error) {
+	highest := 0
+
+	// Shard keys have no parent, so all entities in shard i sort after the
+	// key for shard i and before the key for shard i+1. Query for the first
+	// entity at or after the next shard to find each shard with data.
+	for {
+		start := s.key(ctx, highest+1)
+		it := datastore.NewQuery("").KeysOnly().Filter("__key__ >=", start).Run(ctx)
+
+		next := 0
+		for {
+			key, err := it.Next(nil)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return 0, err
+			}
+
+			// Stop once we are past the keys for this Sharded object
+			root := dsutil.RootKey(key)
+			if root.Kind() != s.name || root.IntID() < 1 {
+				break
+			}
+
+			// Retired markers don't count as data
+			if key.Kind() == kRetiredKind && key.Parent() != nil && key.Parent().Equal(root) {
+				continue
+			}
+
+			next = int(root.IntID())
+			break
+		}
+
+		if next == 0 {
+			return highest, nil
+		}
+		highest = next
+	}
+}
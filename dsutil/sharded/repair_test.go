@@ -0,0 +1,48 @@
+package sharded
+
+import (
+	"appengine"
+
+	"github.com/chippydip/gaege/dsutil"
+	. "github.com/chippydip/gaege/testing"
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *ShardedSuite) TestSharded_config_notInTransaction(c *C) {
+	_, err := New("Test", 3).config(ctx, true)
+	c.Check(err, Equals, ErrNotInTransaction)
+}
+
+func (ctx *ShardedSuite) TestSharded_Repair(c *C) {
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("ShardConfig", "Test"),
+		"Count":   int64(5),
+		"Max":     int64(2),
+	}, Entity{
+		"__key__": ctx.Key("Test", 4, "ShardCounter", 1),
+		"Value":   int64(7),
+	}, Entity{
+		"__key__": ctx.Key("Test", 6, "ShardRetired", 1),
+	})
+
+	// The invalid config is reported instead of panicking
+	counter := NewCounter("Test", 3)
+	c.Check(counter.Increment(ctx), Equals, ErrInvalidConfig)
+	_, err := counter.Value(ctx)
+	c.Check(err, Equals, ErrInvalidConfig)
+
+	c.Assert(counter.Sharded().Repair(ctx), IsNil)
+
+	err = dsutil.RunInTransaction(ctx, func(tx appengine.Context) error {
+		cfg, err := counter.Sharded().config(tx, true)
+		c.Check(cfg.Count, Equals, 3)
+		c.Check(cfg.Max, Equals, 4) // shard 6 only has a retired marker
+		c.Check(cfg.History, HasLen, 1)
+		return err
+	})
+	c.Check(err, IsNil)
+
+	value, err := counter.Value(ctx)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, int64(7))
+}
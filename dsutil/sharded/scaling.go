@@ -0,0 +1,210 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// Scaling controls how the number of shards is adjusted automatically based
+// on the contention observed by Sharded.UpdateRand.
+//
+// Writes and transaction retries are counted in memcache over fixed windows.
+// At the start of each window the previous one is evaluated: if too many
+// writes needed a retry Count is doubled (up to Max), and if very few did it
+// is reduced by a quarter (down to the count passed to New). Lowering Count
+// only stops writes to the extra shards, Vacuum must still be used to merge
+// them and bring Max back down.
+//
+// Every change is recorded in the ShardConfig entity so it can be audited.
+type Scaling struct {
+	// Upper bound for the number of shards (default: 16 times the count
+	// passed to New).
+	Max int
+
+	// Length of the window over which contention is measured (default: 1m).
+	Window time.Duration
+
+	// Minimum amount of time between two changes to Count (default: 5m).
+	Backoff time.Duration
+
+	// Count is raised if more than this fraction of the writes in a window
+	// had to be retried (default: 0.1).
+	RaiseAbove float64
+
+	// Count is lowered if less than this fraction of the writes in a window
+	// had to be retried (default: 0.01).
+	LowerBelow float64
+
+	// Minimum number of writes in a window before Count is raised (default: 10).
+	MinWrites int
+}
+
+// Maximum number of entries kept in shardConfig.History.
+const kMaxHistory = 20
+
+// Return a copy of the options with any unset fields given default values.
+func (opts Scaling) withDefaults(count int) *Scaling {
+	if opts.Max < count {
+		opts.Max = 16 * count
+	}
+	if opts.Window <= 0 {
+		opts.Window = time.Minute
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 5 * time.Minute
+	}
+	if opts.RaiseAbove <= 0 {
+		opts.RaiseAbove = 0.1
+	}
+	if opts.LowerBelow <= 0 {
+		opts.LowerBelow = 0.01
+	}
+	if opts.MinWrites <= 0 {
+		opts.MinWrites = 10
+	}
+	return &opts
+}
+
+// Limit a stored Count to the range allowed by the current options. Without
+// automatic scaling the count passed to New is always used (see newStored for
+// the exception).
+func (s Sharded) clamp(count int) int {
+	if s.stored {
+		return count
+	}
+	if s.scaling == nil || count < s.count {
+		return s.count
+	}
+	if count > s.scaling.Max {
+		return s.scaling.Max
+	}
+	return count
+}
+
+// Memcache key for a contention statistic of the given window.
+func (s Sharded) scalingKey(stat string, window int64) string {
+	return "sharded:" + s.name + ":" + stat + ":" + strconv.FormatInt(window, 10)
+}
+
+// Record a write (and the number of times it had to be retried) and evaluate
+// the previous window once the first write of a new window is seen. Failures
+// are logged, but otherwise ignored since they only affect scaling.
+func (s Sharded) observe(ctx appengine.Context, retries int) {
+	window := time.Now().UnixNano() / int64(s.scaling.Window)
+
+	writes, err := s.incrementWindow(ctx, s.scalingKey("w", window), 1)
+	if err != nil {
+		ctx.Warningf("sharded: memcache.Increment: %v", err)
+		return
+	}
+	if retries > 0 {
+		if _, err := s.incrementWindow(ctx, s.scalingKey("r", window), int64(retries)); err != nil {
+			ctx.Warningf("sharded: memcache.Increment: %v", err)
+		}
+	}
+
+	// Only the first write of each window evaluates the previous one
+	if writes == 1 {
+		if err := s.evaluate(ctx, window-1); err != nil {
+			ctx.Warningf("sharded: scaling %q: %v", s.name, err)
+		}
+	}
+}
+
+// Add to a contention statistic. Statistics are only needed until the next
+// window has been evaluated, so they are created with an expiration to keep old
+// windows from piling up in memcache (memcache.Increment can't set one).
+func (s Sharded) incrementWindow(ctx appengine.Context, key string, delta int64) (uint64, error) {
+	n, err := memcache.IncrementExisting(ctx, key, delta)
+	if err != memcache.ErrCacheMiss {
+		return n, err
+	}
+
+	err = memcache.Add(ctx, &memcache.Item{
+		Key:        key,
+		Value:      []byte("0"),
+		Expiration: 2 * s.scaling.Window,
+	})
+	if err != nil && err != memcache.ErrNotStored {
+		return 0, err
+	}
+	return memcache.IncrementExisting(ctx, key, delta)
+}
+
+// Evaluate the contention statistics for a window and adjust Count if needed.
+func (s Sharded) evaluate(ctx appengine.Context, window int64) error {
+	keys := []string{s.scalingKey("w", window), s.scalingKey("r", window)}
+	items, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	var stats [2]int64
+	for i, key := range keys {
+		if item := items[key]; item != nil {
+			stats[i], _ = strconv.ParseInt(string(item.Value), 10, 64)
+		}
+	}
+	writes, retries := stats[0], stats[1]
+	if writes == 0 {
+		return nil
+	}
+
+	// Decide which way (if any) to scale
+	ratio := float64(retries) / float64(writes)
+	var scale func(int) int
+	switch {
+	case ratio > s.scaling.RaiseAbove && writes >= int64(s.scaling.MinWrites):
+		scale = func(count int) int { return count * 2 }
+	case ratio < s.scaling.LowerBelow:
+		scale = func(count int) int { return count - (count+3)/4 }
+	default:
+		return nil
+	}
+
+	changed := false
+	err = dsutil.RunInTransaction(ctx, func(ctx appengine.Context) error {
+		changed = false
+		cfg, err := s.config(ctx, true)
+		if err != nil {
+			return err
+		}
+
+		// Give the previous change some time to take effect
+		now := time.Now()
+		if now.Sub(cfg.Scaled) < s.scaling.Backoff {
+			return nil
+		}
+
+		count := s.clamp(scale(cfg.Count))
+		if count == cfg.Count {
+			return nil
+		}
+
+		// Record the decision
+		entry := fmt.Sprintf("Count %d -> %d (%d of %d writes retried)",
+			cfg.Count, count, retries, writes)
+		cfg.record(now, entry)
+		cfg.Scaled = now
+
+		cfg.setCount(count)
+		ctx.Infof("sharded: scaling %q: %s", s.name, entry)
+
+		if _, err = datastore.Put(ctx, s.cfgKey(ctx), &cfg); err != nil {
+			return err
+		}
+		s.uncache(ctx)
+		changed = true
+		return nil
+	})
+	if err == nil && changed {
+		s.uncache(ctx) // again, now that the change is committed
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package sharded
+
+import (
+	"appengine/memcache"
+	"strconv"
+	"time"
+
+	. "github.com/chippydip/gaege/testing"
+	. "launchpad.net/gocheck"
+)
+
+// Store the contention statistics of a window.
+func (ctx *ShardedSuite) putWindow(c *C, s Sharded, window int64, writes, retries int) {
+	for stat, n := range map[string]int{"w": writes, "r": retries} {
+		err := memcache.Set(ctx, &memcache.Item{
+			Key:   s.scalingKey(stat, window),
+			Value: []byte(strconv.Itoa(n)),
+		})
+		c.Assert(err, IsNil)
+	}
+}
+
+func (ctx *ShardedSuite) TestSharded_observe(c *C) {
+	s := New("Test", 2).WithScaling(Scaling{Window: time.Hour})
+	window := time.Now().UnixNano() / int64(time.Hour)
+	s.observe(ctx, 0)
+	s.observe(ctx, 3)
+
+	keys := []string{s.scalingKey("w", window), s.scalingKey("r", window)}
+	items, err := memcache.GetMulti(ctx, keys)
+	c.Assert(err, IsNil)
+	c.Assert(items, HasLen, 2)
+	c.Check(string(items[keys[0]].Value), Equals, "2")
+	c.Check(string(items[keys[1]].Value), Equals, "3")
+}
+
+func (ctx *ShardedSuite) TestSharded_evaluate_raise(c *C) {
+	s := New("Test", 2).WithScaling(Scaling{Max: 8})
+	ctx.putWindow(c, s, 1, 20, 5)
+	c.Assert(s.evaluate(ctx, 1), IsNil)
+
+	cfg, err := s.config(ctx, false)
+	c.Check(err, IsNil)
+	c.Check(cfg.Count, Equals, 4)
+	c.Check(cfg.Max, Equals, 4)
+	c.Assert(cfg.History, HasLen, 1)
+	c.Check(cfg.History[0], Matches, `.*: Count 2 -> 4 \(5 of 20 writes retried\)`)
+
+	// Nothing changes again until the backoff has passed
+	ctx.putWindow(c, s, 2, 20, 5)
+	c.Assert(s.evaluate(ctx, 2), IsNil)
+	cfg, err = s.config(ctx, false)
+	c.Check(err, IsNil)
+	c.Check(cfg.Count, Equals, 4)
+	c.Check(cfg.History, HasLen, 1)
+}
+
+func (ctx *ShardedSuite) TestSharded_evaluate_limits(c *C) {
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("ShardConfig", "Test"),
+		"Count":   int64(8),
+		"Max":     int64(8),
+	})
+	s := New("Test", 2).WithScaling(Scaling{Max: 8})
+
+	// Already at the upper bound
+	ctx.putWindow(c, s, 1, 100, 50)
+	c.Assert(s.evaluate(ctx, 1), IsNil)
+
+	// Not enough writes to be sure
+	ctx.putWindow(c, s, 2, 5, 5)
+	c.Assert(s.evaluate(ctx, 2), IsNil)
+
+	// In between the thresholds
+	ctx.putWindow(c, s, 3, 100, 5)
+	c.Assert(s.evaluate(ctx, 3), IsNil)
+
+	cfg, err := s.config(ctx, false)
+	c.Check(err, IsNil)
+	c.Check(cfg.Count, Equals, 8)
+	c.Check(cfg.History, HasLen, 0)
+}
+
+func (ctx *ShardedSuite) TestSharded_evaluate_lower(c *C) {
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("ShardConfig", "Test"),
+		"Count":   int64(8),
+		"Max":     int64(8),
+	})
+	s := New("Test", 2).WithScaling(Scaling{Max: 8, Backoff: 1})
+
+	// Count drops by a quarter, but Max is left for Vacuum
+	ctx.putWindow(c, s, 1, 100, 0)
+	c.Assert(s.evaluate(ctx, 1), IsNil)
+	cfg, err := s.config(ctx, false)
+	c.Check(err, IsNil)
+	c.Check(cfg.Count, Equals, 6)
+	c.Check(cfg.Max, Equals, 8)
+	c.Assert(cfg.History, HasLen, 1)
+	c.Check(cfg.History[0], Matches, `.*: Count 8 -> 6 \(0 of 100 writes retried\)`)
+
+	// But never below the count passed to New
+	for window := int64(2); window < 10; window++ {
+		ctx.putWindow(c, s, window, 100, 0)
+		c.Assert(s.evaluate(ctx, window), IsNil)
+	}
+	cfg, err = s.config(ctx, false)
+	c.Check(err, IsNil)
+	c.Check(cfg.Count, Equals, 2)
+	c.Check(cfg.History, HasLen, 4) // 6 -> 4 -> 3 -> 2
+}
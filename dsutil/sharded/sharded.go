@@ -3,17 +3,38 @@ package sharded
 import (
 	"appengine"
 	"appengine/datastore"
+	"errors"
 	"math/rand"
+	"time"
 
 	"github.com/chippydip/gaege/dsutil"
 )
 
+var (
+	// ErrInvalidConfig is returned when the stored ShardConfig entity is not
+	// consistent (see Sharded.Repair).
+	ErrInvalidConfig = errors.New("sharded: invalid configuration found in datastore")
+
+	// ErrNotInTransaction is returned by methods that must be called from
+	// within a transaction if they are not.
+	ErrNotInTransaction = errors.New("sharded: must be called from a transaction")
+)
+
 type Sharded struct {
 	// Name of the sharded entity group (must not be empty).
 	name string
 
 	// Desired number of shards to spread writes over.
 	count int
+
+	// Automatic scaling options (nil if the shard count is fixed).
+	scaling *Scaling
+
+	// Record usage statistics (see WithStats).
+	stats bool
+
+	// Use the stored Count as is (see newStored).
+	stored bool
 }
 
 // Create a new Shards object with the given name and at least `count` shards.
@@ -33,6 +54,13 @@ func New(name string, count int) Sharded {
 	}
 }
 
+// Create a Sharded object for tasks and handlers that only know the name of
+// the shards and not the options they are normally used with. The stored
+// Count is used as is, rather than being limited to the count passed to New.
+func newStored(name string) Sharded {
+	return Sharded{name: name, stored: true}
+}
+
 // Name returns the name that was passed to New.
 func (s Sharded) Name() string {
 	return s.name
@@ -43,37 +71,166 @@ func (s Sharded) Count() int {
 	return s.count
 }
 
+// WithStats returns a copy of s that records usage statistics for each shard
+// (see Stats).
+func (s Sharded) WithStats() Sharded {
+	s.stats = true
+	return s
+}
+
+// WithScaling returns a copy of s that automatically adjusts the number of
+// shards that are written to based on observed contention. The count passed
+// to New becomes the lower bound for the number of shards.
+func (s Sharded) WithScaling(opts Scaling) Sharded {
+	s.scaling = opts.withDefaults(s.count)
+	return s
+}
+
 // UpdateRand is a convenience method that starts a transaction, selects a
 // random shard, and then calls the given function with the randomly selected
 // shard's key.
 func (s Sharded) UpdateRand(ctx appengine.Context, update func(appengine.Context, *datastore.Key) error) error {
-	return dsutil.RunInTransaction(ctx, func(ctx appengine.Context) error {
-		// Get a random shard to update
-		key, err := s.Rand(ctx)
+	return s.update(ctx, s.Rand, update)
+}
+
+// Start a transaction, select a shard and call update with the selected key.
+func (s Sharded) update(ctx appengine.Context, pick func(appengine.Context) (*datastore.Key, error), update func(appengine.Context, *datastore.Key) error) error {
+	start := time.Now()
+	attempts := 0
+	var picked []int // shard selected by each attempt
+	err := dsutil.RunInTransaction(ctx, func(ctx appengine.Context) error {
+		attempts++
+
+		// Get the shard to update
+		key, err := pick(ctx)
 		if err != nil {
 			return err
 		}
+		picked = append(picked, int(key.IntID()))
 
 		// Call the update function
 		return update(ctx, key)
 	})
+
+	// Record usage statistics
+	if s.stats {
+		s.recordUpdate(ctx, picked, err, time.Since(start))
+		flushDueStats(ctx)
+	}
+
+	// Record any contention for automatic scaling
+	if s.scaling != nil && attempts > 0 {
+		retries := attempts - 1
+		if err == datastore.ErrConcurrentTransaction {
+			retries++ // the last attempt failed as well
+		}
+		s.observe(ctx, retries)
+	}
+
+	return err
 }
 
 // Rand selects a random shard and return its key. It must be called from
 // within a cross-group transaction.
 func (s Sharded) Rand(ctx appengine.Context) (*datastore.Key, error) {
+	return s.pick(ctx, func(count int) int {
+		// Pick a shard [1, count]
+		return rand.Intn(count) + 1
+	})
+}
+
+// Select a shard using the given function (which is passed the current Count
+// and should return an index in [1, count]) and return its key.
+//
+// The shard is normally picked using a cached copy of the config. To make sure
+// a stale cache can never cause a write to a shard that has already been
+// merged by Vacuum, the retired marker Vacuum leaves in each merged shard is
+// read as part of the transaction, and the stored config is used instead if
+// the marker is found. Vacuum removes the markers after invalidating the
+// cache, so a missing marker only counts if the cache version is unchanged.
+func (s Sharded) pick(ctx appengine.Context, index func(count int) int) (*datastore.Key, error) {
+	// Try the cached config first (unless it needs to be updated)
+	cfg, version, err := s.cachedConfig(ctx)
+	if err == nil && version != 0 && cfg.validate() == nil && s.clamp(cfg.Count) == cfg.Count {
+		i := index(cfg.Count)
+		key := s.key(ctx, i)
+		if retired, err := isRetired(ctx, key); err != nil {
+			return nil, err
+		} else if !retired && s.cacheVersion(ctx) == version {
+			s.record(ctx, kStatSelections, i, 1)
+			return key, nil
+		}
+	}
+
 	// Get the shard config
-	cfg, err := s.config(ctx, true)
+	cfg, err = s.config(ctx, true)
 	if err != nil {
 		return nil, err
 	}
 
-	// Pick a shard [1, count] and generate a parent key for that shard
-	return s.key(ctx, rand.Intn(cfg.Count)+1), nil
+	// Generate a parent key for the selected shard
+	i := index(cfg.Count)
+	key := s.key(ctx, i)
+
+	// The stored config says this shard is in use, so clear any marker left
+	// by an earlier Vacuum to allow the cached config to be used again
+	if err := unretire(ctx, key); err != nil {
+		return nil, err
+	}
+	s.record(ctx, kStatSelections, i, 1)
+	return key, nil
+}
+
+// For selects the shard that the given item should be written to and returns
+// its key. It must be called from within a cross-group transaction.
+//
+// Unlike Rand, the same item is always mapped to the same shard as long as
+// Count doesn't change. Shards are selected using jump consistent hashing, so
+// when Count is raised from n to n+1 only 1/(n+1) of the items move to the new
+// shard. Use Locate to find all shards that may hold data for an item.
+func (s Sharded) For(ctx appengine.Context, item string) (*datastore.Key, error) {
+	h := hashString(item)
+	return s.pick(ctx, func(count int) int {
+		return jumpHash(h, count) + 1
+	})
+}
+
+// UpdateFor is like UpdateRand, but uses For to select the shard to update.
+func (s Sharded) UpdateFor(ctx appengine.Context, item string, update func(appengine.Context, *datastore.Key) error) error {
+	return s.update(ctx, func(ctx appengine.Context) (*datastore.Key, error) {
+		return s.For(ctx, item)
+	}, update)
+}
+
+// Locate returns the keys of all shards that may contain data written for
+// the given item by For. The shard that For would currently select is always
+// first.
+//
+// Since items move to other shards when Count changes (and Vacuum merges each
+// shard into a lower one), this is the set of shards the item was mapped to
+// for any Count up to the largest Max ever used, along with the shards that
+// Vacuum may have merged them into. This usually contains only a handful of
+// keys.
+func (s Sharded) Locate(ctx appengine.Context, item string) ([]*datastore.Key, error) {
+	// Get the shard config
+	cfg, err := s.config(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	indexes := locate(hashString(item), cfg)
+	keys := make([]*datastore.Key, len(indexes))
+	for x, i := range indexes {
+		keys[x] = s.key(ctx, i)
+	}
+	return keys, nil
 }
 
 // All returns a slice of all sharded keys that should be read from.
 func (s Sharded) All(ctx appengine.Context) ([]*datastore.Key, error) {
+	if s.stats {
+		flushDueStats(ctx) // includes selections made by Rand and For
+	}
+
 	// Get the shard config
 	cfg, err := s.config(ctx, false)
 	if err != nil {
@@ -88,6 +245,11 @@ func (s Sharded) All(ctx appengine.Context) ([]*datastore.Key, error) {
 	return keys, nil
 }
 
+// MergeFunc is the type of function used by Vacuum to merge shards. It should
+// read all data from `src` and add it to `dst` and then delete all data from
+// `src`. It is always called from within a transaction.
+type MergeFunc func(ctx appengine.Context, src, dst *datastore.Key) error
+
 // Vacuum allows the number of shards to be decreased. By default, the config
 // keeps track of the largest number of shards that have ever been used and
 // performs reads on all of these shards while writes only use the currently
@@ -96,52 +258,10 @@ func (s Sharded) All(ctx appengine.Context) ([]*datastore.Key, error) {
 // and then delete all data from `src`. If the count is ever increased again
 // it is important that all data is actually deleted so that it doesn't
 // accidentally get picked up again. It is called repeatedly to merge as single
-// pair of shards until Max == Count.
-// TODO: Limited batching could be supported, but the transaction must already
-// use 3 different entity groups, so the max batch size would be 3 (for a
-// total of 5 entity groups in the transaction).
+// pair of shards until Max == Count. Use VacuumBatch to merge several pairs of
+// shards in each transaction.
 func (s Sharded) Vacuum(ctx appengine.Context, merge func(c appengine.Context, src, dst *datastore.Key) error) error {
-	done := false
-	for {
-		// Use a separate transaction for each merge
-		err := dsutil.RunInTransaction(ctx, func(ctx appengine.Context) error {
-			// Get the shard config
-			cfg, err := s.config(ctx, true)
-			if err != nil {
-				return err
-			}
-
-			// Stop if there is nothing that needs to be merged
-			if cfg.Max <= cfg.Count {
-				done = true
-				return nil
-			}
-
-			// Merge the last shard into a randomly selected one
-			src := s.key(ctx, cfg.Max)
-			dst := s.key(ctx, rand.Intn(cfg.Count)+1)
-			if err := merge(ctx, src, dst); err != nil {
-				return err
-			}
-
-			// Decrement the max value and save
-			cfg.Max--
-			cfgKey := s.cfgKey(ctx)
-			if _, err := datastore.Put(ctx, cfgKey, cfg); err != nil {
-				return err
-			}
-
-			// Check the stopping condition again to save a transaction
-			// and initial config read if we are done at this point.
-			if cfg.Max <= cfg.Count {
-				done = true
-			}
-			return nil
-		})
-		if done || err != nil {
-			return err
-		}
-	}
+	return s.VacuumBatch(ctx, merge, VacuumOptions{BatchSize: 1})
 }
 
 // Create a key for the i-th shard of the data.
@@ -162,6 +282,31 @@ type shardConfig struct {
 	// Total number of shards that have ever been written to.
 	// This should be the largest value Count has ever had.
 	Max int `datastore:",noindex"`
+
+	// Largest value Max has ever had (Max may be lowered by Vacuum). Used to
+	// find where data written by For may have ended up (see Locate).
+	Peak int `datastore:",noindex"`
+
+	// Lowest value Count had when Vacuum merged shards (zero if it never has).
+	// Also used by Locate.
+	Floor int `datastore:",noindex"`
+
+	// Time of the last automatic change to Count (see Sharded.WithScaling).
+	Scaled time.Time `datastore:",noindex"`
+
+	// Log of the most recent automatic changes to Count (oldest first).
+	History []string `datastore:",noindex"`
+}
+
+// Set Count, raising Max (and Peak) as needed.
+func (cfg *shardConfig) setCount(count int) {
+	cfg.Count = count
+	if cfg.Count > cfg.Max {
+		cfg.Max = cfg.Count
+	}
+	if cfg.Max > cfg.Peak {
+		cfg.Peak = cfg.Max
+	}
 }
 
 // Create a key for this shards config entity.
@@ -169,18 +314,44 @@ func (s Sharded) cfgKey(ctx appengine.Context) *datastore.Key {
 	return datastore.NewKey(ctx, kShardConfigKind, s.name, 0, nil)
 }
 
+// Check that the config is consistent.
+func (cfg shardConfig) validate() error {
+	if cfg.Count < 0 || cfg.Count > cfg.Max || (cfg.Count == 0 && cfg.Max > 0) {
+		return ErrInvalidConfig
+	}
+	return nil
+}
+
+// Add an entry to the config's history (keeping only the most recent ones).
+func (cfg *shardConfig) record(now time.Time, entry string) {
+	cfg.History = append(cfg.History, now.UTC().Format(time.RFC3339)+": "+entry)
+	if len(cfg.History) > kMaxHistory {
+		cfg.History = cfg.History[len(cfg.History)-kMaxHistory:]
+	}
+}
+
 // Get the current config, optionally updating the stored values. In an update is
-// requested, then the method should be called from within a transaction context.
+// requested, then the method must be called from within a transaction context.
 func (s Sharded) config(ctx appengine.Context, update bool) (cfg shardConfig, err error) {
+	if update && !dsutil.IsInTransaction(ctx) {
+		return cfg, ErrNotInTransaction
+	}
+
 	// Get the configuration key
 	cfgKey := s.cfgKey(ctx)
 
-	// Read the current config
-	if err = datastore.Get(ctx, cfgKey, &cfg); err != nil && err != datastore.ErrNoSuchEntity {
+	// Read the current config (reads that don't update can use the cache)
+	if !update {
+		cfg, _, err = s.cachedConfig(ctx)
+	} else if err = datastore.Get(ctx, cfgKey, &cfg); err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	if err != nil {
 		return cfg, err
 	}
-	if cfg.Count > cfg.Max {
-		panic("sharded: invalid configuration found in datastore (Count > Max)")
+	if err = cfg.validate(); err != nil {
+		ctx.Errorf("sharded: %q has Count = %d, Max = %d (use Repair to fix)", s.name, cfg.Count, cfg.Max)
+		return cfg, err
 	}
 
 	// Get the max value
@@ -194,26 +365,17 @@ func (s Sharded) config(ctx appengine.Context, update bool) (cfg shardConfig, er
 	// Update the config if required. This is calculation is repeatable for reads
 	// and writes should be using update == true to store any changes made here.
 	modified := false
-	if cfg.Count != s.count {
-		cfg.Count = s.count
-		if cfg.Count > cfg.Max {
-			cfg.Max = cfg.Count
-		}
+	if count := s.clamp(cfg.Count); cfg.Count != count {
+		cfg.setCount(count)
 		modified = true
 	}
 
-	// Update if requested
-	if update {
-		if !dsutil.IsInTransaction(ctx) {
-			panic("sharded: must be called from a transaction if update is true")
-		}
-
-		// But only if the configuration needs to be changed
-		if modified {
-			if _, err := datastore.Put(ctx, cfgKey, &cfg); err != nil {
-				return cfg, err
-			}
+	// Update if requested, but only if the configuration needs to be changed
+	if update && modified {
+		if _, err := datastore.Put(ctx, cfgKey, &cfg); err != nil {
+			return cfg, err
 		}
+		s.uncache(ctx)
 	}
 
 	return cfg, nil
@@ -0,0 +1,118 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"testing"
+
+	. "github.com/chippydip/gaege/testing"
+	. "launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&ShardedSuite{})
+
+type ShardedSuite struct {
+	Context
+}
+
+func (ctx *ShardedSuite) SetUpSuite(c *C) {
+	ctx.SetUp(c)
+}
+
+func (ctx *ShardedSuite) TearDownSuite(c *C) {
+	ctx.TearDown(c)
+}
+
+func (ctx *ShardedSuite) TearDownTest(c *C) {
+	ctx.Reset(c)
+}
+
+func (ctx *ShardedSuite) TestSharded_All_default(c *C) {
+	s := New("Test", 3)
+	keys, err := s.All(ctx)
+	c.Check(err, IsNil)
+	c.Assert(keys, HasLen, 3)
+	for i, key := range keys {
+		c.Check(key, KeyEquals, "Test", "", i+1, false)
+	}
+}
+
+func (ctx *ShardedSuite) TestSharded_WithScaling_keepsStoredCount(c *C) {
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("ShardConfig", "Test"),
+		"Count":   int64(4),
+		"Max":     int64(4),
+	})
+
+	s := New("Test", 2).WithScaling(Scaling{Max: 8})
+	err := s.UpdateRand(ctx, func(appengine.Context, *datastore.Key) error {
+		return nil
+	})
+	c.Check(err, IsNil)
+
+	cfg, err := s.config(ctx, false)
+	c.Check(err, IsNil)
+	c.Check(cfg.Count, Equals, 4)
+	c.Check(cfg.Max, Equals, 4)
+
+	// Without scaling the count passed to New is used
+	cfg, err = New("Test", 2).config(ctx, false)
+	c.Check(err, IsNil)
+	c.Check(cfg.Count, Equals, 2)
+	c.Check(cfg.Max, Equals, 4)
+}
+
+// Store a vacuumed counter with a single shard and cache an outdated config
+// with four shards (under an old version if `invalidated` is true).
+func (ctx *ShardedSuite) putStaleCache(c *C, invalidated bool) Sharded {
+	counter := NewCounter("Test", 4)
+	c.Assert(counter.Increment(ctx), IsNil)
+	keys, err := counter.Sharded().All(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 4)
+
+	s := New("Test", 1)
+	c.Assert(s.Vacuum(ctx, MergeCounter), IsNil)
+
+	version := s.cacheVersion(ctx)
+	if invalidated {
+		version--
+	}
+	err = memcache.Gob.Set(ctx, &memcache.Item{
+		Key:    s.cacheKey(),
+		Object: cacheItem{version, shardConfig{Count: 4, Max: 4}},
+	})
+	c.Assert(err, IsNil)
+	return s
+}
+
+// Check that writes only go to the remaining shard.
+func (ctx *ShardedSuite) checkSingleShard(c *C, s Sharded) {
+	for i := 0; i < 10; i++ {
+		err := s.UpdateRand(ctx, func(_ appengine.Context, key *datastore.Key) error {
+			c.Check(key, KeyEquals, "Test", "", 1, false)
+			return nil
+		})
+		c.Check(err, IsNil)
+	}
+}
+
+func (ctx *ShardedSuite) TestSharded_Rand_staleCache(c *C) {
+	// Cached before the vacuum was committed
+	s := ctx.putStaleCache(c, true)
+	c.Check(ctx.GetAll(c), HasLen, 2) // no retired markers are left
+	ctx.checkSingleShard(c, s)
+}
+
+func (ctx *ShardedSuite) TestSharded_Rand_staleCacheNotInvalidated(c *C) {
+	// Invalidating the cache failed, so the retired markers were kept
+	s := ctx.putStaleCache(c, false)
+	for i := 2; i <= 4; i++ {
+		ctx.PutAll(c, Entity{"__key__": ctx.Key("Test", i, "ShardRetired", 1)})
+	}
+	ctx.checkSingleShard(c, s)
+}
@@ -0,0 +1,269 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/user"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// Names of the statistics recorded for each shard.
+const (
+	kStatSelections = "sel"   // times the shard was picked by Rand or For
+	kStatUpdates    = "upd"   // updates (UpdateRand/UpdateFor) that ended on the shard
+	kStatRetries    = "retry" // attempts on the shard that hit a concurrent transaction
+	kStatLatency    = "lat"   // total latency of the updates in microseconds
+	kStatMerges     = "merge" // times the shard was merged by Vacuum
+	kStatMergeTime  = "mlat"  // total time spent merging the shard in microseconds
+)
+
+var statNames = [...]string{kStatSelections, kStatUpdates, kStatRetries, kStatLatency, kStatMerges, kStatMergeTime}
+
+// How often each instance adds its buffered statistics to memcache.
+const kStatsFlushInterval = 10 * time.Second
+
+// Statistics are buffered in memory and periodically added to counters in
+// memcache, so recording them doesn't add any round trips to most requests and
+// the shared counters are only touched a few times a minute by each instance.
+var statsBuf = struct {
+	sync.Mutex
+	m       map[statKey]int64
+	flushed time.Time
+}{m: map[statKey]int64{}}
+
+type statKey struct {
+	name  string
+	stat  string
+	index int
+}
+
+// Memcache key for a statistic.
+func (k statKey) String() string {
+	return "sharded:" + k.name + ":stat:" + k.stat + ":" + strconv.Itoa(k.index)
+}
+
+// ShardStats contains the usage statistics of a single shard.
+type ShardStats struct {
+	Index      int   // shard number in [1, Max]
+	Selections int64 // times picked by Rand or For
+	Updates    int64 // UpdateRand or UpdateFor calls that ended on this shard
+	Retries    int64 // attempts on this shard that had to be retried
+	Latency    int64 // mean latency of the updates in microseconds
+	Merges     int64 // times merged by Vacuum
+	MergeTime  int64 // mean time spent merging in microseconds
+}
+
+// Stats returns the usage statistics for every shard that is read from
+// (shard i is at index i-1). Statistics are only recorded by Sharded objects
+// created with WithStats. They are kept in memcache, so they may be reset
+// at any time by eviction, and each instance only adds its own statistics
+// every few seconds (after an update, a vacuum step or a call to All, so
+// selections made by calling Rand or For directly wait for one of those).
+func (s Sharded) Stats(ctx appengine.Context) ([]ShardStats, error) {
+	cfg, err := s.config(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.shardStats(ctx, cfg)
+}
+
+// Read the statistics of the shards in cfg (see Stats).
+func (s Sharded) shardStats(ctx appengine.Context, cfg shardConfig) ([]ShardStats, error) {
+	flushStats(ctx, takeStats(true))
+
+	keys := make([]string, 0, cfg.Max*len(statNames))
+	for i := 1; i <= cfg.Max; i++ {
+		for _, stat := range statNames {
+			keys = append(keys, statKey{s.name, stat, i}.String())
+		}
+	}
+	items, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]ShardStats, cfg.Max)
+	for i := range stats {
+		values := map[string]int64{}
+		for _, stat := range statNames {
+			if item := items[statKey{s.name, stat, i + 1}.String()]; item != nil {
+				values[stat], _ = strconv.ParseInt(string(item.Value), 10, 64)
+			}
+		}
+
+		stats[i] = ShardStats{
+			Index:      i + 1,
+			Selections: values[kStatSelections],
+			Updates:    values[kStatUpdates],
+			Retries:    values[kStatRetries],
+			Merges:     values[kStatMerges],
+		}
+		if n := values[kStatUpdates]; n > 0 {
+			stats[i].Latency = values[kStatLatency] / n
+		}
+		if n := values[kStatMerges]; n > 0 {
+			stats[i].MergeTime = values[kStatMergeTime] / n
+		}
+	}
+	return stats, nil
+}
+
+// ResetStats clears the usage statistics of every shard.
+func (s Sharded) ResetStats(ctx appengine.Context) error {
+	takeStats(true) // drop anything buffered by this instance
+
+	cfg, err := s.config(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for i := 1; i <= cfg.Max; i++ {
+		for _, stat := range statNames {
+			keys = append(keys, statKey{s.name, stat, i}.String())
+		}
+	}
+	return ignoreCacheMisses(memcache.DeleteMulti(ctx, keys))
+}
+
+// StatsPath is the URL path that StatsHandler should be mapped to:
+//
+//	http.Handle(sharded.StatsPath, sharded.StatsHandler)
+const StatsPath = "/_ah/sharded/stats"
+
+// StatsHandler serves the statistics of the Sharded object named by the
+// "name" parameter as JSON (for debugging). Only administrators of the
+// application may use it.
+var StatsHandler http.Handler = http.HandlerFunc(handleStats)
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if !user.IsAdmin(ctx) {
+		http.Error(w, "sharded: stats are only available to administrators", http.StatusForbidden)
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	s := newStored(name)
+	cfg, err := s.config(ctx, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stats, err := s.shardStats(ctx, cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Name    string
+		Count   int
+		Max     int
+		History []string
+		Shards  []ShardStats
+	}{name, cfg.Count, cfg.Max, cfg.History, stats})
+}
+
+// Add to a statistic (if enabled). Statistics are only buffered, since this
+// is also called from transactions (see flushDueStats).
+func (s Sharded) record(ctx appengine.Context, stat string, index int, n int64) {
+	if !s.stats {
+		return
+	}
+
+	statsBuf.Lock()
+	statsBuf.m[statKey{s.name, stat, index}] += n
+	statsBuf.Unlock()
+}
+
+// Flush the buffered statistics if it's time. This is called once an update
+// or vacuum step has finished (and by All), so transactions don't wait for
+// memcache.
+func flushDueStats(ctx appengine.Context) {
+	if !dsutil.IsInTransaction(ctx) {
+		flushStats(ctx, takeStats(false))
+	}
+}
+
+// Record the outcome of an update given the shard picked by each attempt.
+func (s Sharded) recordUpdate(ctx appengine.Context, picked []int, err error, latency time.Duration) {
+	for i, index := range picked {
+		if i < len(picked)-1 || err == datastore.ErrConcurrentTransaction {
+			s.record(ctx, kStatRetries, index, 1)
+		} else {
+			s.record(ctx, kStatUpdates, index, 1)
+			s.record(ctx, kStatLatency, index, int64(latency/time.Microsecond))
+		}
+	}
+}
+
+// Record a vacuum step that merged shards [first, first+n).
+func (s Sharded) recordMerges(ctx appengine.Context, first, n int, latency time.Duration) {
+	each := int64(latency/time.Microsecond) / int64(n)
+	for i := first; i < first+n; i++ {
+		s.record(ctx, kStatMerges, i, 1)
+		s.record(ctx, kStatMergeTime, i, each)
+	}
+}
+
+// Remove and return the buffered statistics if they are due to be flushed
+// (or if force is true).
+func takeStats(force bool) map[statKey]int64 {
+	statsBuf.Lock()
+	defer statsBuf.Unlock()
+
+	now := time.Now()
+	if len(statsBuf.m) == 0 || (!force && now.Sub(statsBuf.flushed) < kStatsFlushInterval) {
+		return nil
+	}
+
+	m := statsBuf.m
+	statsBuf.m = map[statKey]int64{}
+	statsBuf.flushed = now
+	return m
+}
+
+// Add statistics to the counters in memcache. Any that fail are put back in
+// the buffer for the next flush, and the failure is logged.
+func flushStats(ctx appengine.Context, m map[statKey]int64) {
+	failed := 0
+	var lastErr error
+	for key, n := range m {
+		if _, err := memcache.Increment(ctx, key.String(), n, 0); err != nil {
+			statsBuf.Lock()
+			statsBuf.m[key] += n
+			statsBuf.Unlock()
+			failed, lastErr = failed+1, err
+		}
+	}
+	if failed > 0 {
+		ctx.Warningf("sharded: memcache.Increment failed for %d stats: %v", failed, lastErr)
+	}
+}
+
+// Filter ErrCacheMiss out of the result of a memcache.DeleteMulti call.
+func ignoreCacheMisses(err error) error {
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, e := range me {
+			if e != nil && e != memcache.ErrCacheMiss {
+				return err
+			}
+		}
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *ShardedSuite) TestSharded_Stats(c *C) {
+	s := New("Test", 3).WithStats()
+	c.Assert(s.ResetStats(ctx), IsNil)
+
+	for i := 0; i < 5; i++ {
+		err := s.UpdateFor(ctx, "item", func(appengine.Context, *datastore.Key) error {
+			return nil
+		})
+		c.Assert(err, IsNil)
+	}
+	index := jumpHash(hashString("item"), 3) + 1
+
+	stats, err := s.Stats(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(stats, HasLen, 3)
+	for i, st := range stats {
+		c.Check(st.Index, Equals, i+1)
+		if st.Index == index {
+			c.Check(st.Selections, Equals, int64(5))
+			c.Check(st.Updates, Equals, int64(5))
+		} else {
+			c.Check(st.Selections, Equals, int64(0))
+			c.Check(st.Updates, Equals, int64(0))
+		}
+		c.Check(st.Retries, Equals, int64(0))
+	}
+
+	c.Assert(s.ResetStats(ctx), IsNil)
+	stats, err = s.Stats(ctx)
+	c.Assert(err, IsNil)
+	c.Check(stats[index-1].Updates, Equals, int64(0))
+}
@@ -0,0 +1,118 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/taskqueue"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// VacuumPath is the URL path that VacuumHandler should be mapped to:
+//
+//	http.Handle(sharded.VacuumPath, sharded.VacuumHandler)
+const VacuumPath = "/_ah/sharded/vacuum"
+
+// VacuumHandler runs the vacuum tasks queued by EnqueueVacuum.
+var VacuumHandler http.Handler = http.HandlerFunc(handleVacuum)
+
+// Merge functions that can be used by vacuum tasks (see RegisterMerge).
+var merges = map[string]MergeFunc{}
+
+// RegisterMerge makes a merge function available to EnqueueVacuum under the
+// given name. It should be called during program initialization and panics
+// if the name is already in use.
+func RegisterMerge(name string, merge MergeFunc) {
+	if _, ok := merges[name]; ok {
+		panic("sharded: merge function " + strconv.Quote(name) + " already registered")
+	}
+	merges[name] = merge
+}
+
+// EnqueueVacuum starts vacuuming s in the background using a chain of tasks
+// on the given queue ("" for the default queue). Each task merges a single
+// shard using the merge function registered under the given name and then
+// queues the next task until Max == Count. Tasks reject requests that weren't
+// made by the task queue (see dsutil.IsTaskRequest).
+//
+// Tasks are named after the step they perform, so retried or duplicated tasks
+// don't merge any additional shards and don't start a second chain.
+func (s Sharded) EnqueueVacuum(ctx appengine.Context, merge, queue string) error {
+	if _, ok := merges[merge]; !ok {
+		return fmt.Errorf("sharded: unknown merge function %q", merge)
+	}
+
+	// Make sure the stored config reflects s before handing off to the tasks
+	var cfg shardConfig
+	err := dsutil.RunInTransaction(ctx, func(ctx appengine.Context) (err error) {
+		cfg, err = s.config(ctx, true)
+		return err
+	})
+	if err != nil || cfg.Max <= cfg.Count {
+		return err
+	}
+
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+	return enqueueVacuumStep(ctx, s.name, merge, queue, run, cfg.Max)
+}
+
+// Queue the task that merges a shard while Max == `max`.
+func enqueueVacuumStep(ctx appengine.Context, name, merge, queue, run string, max int) error {
+	t := taskqueue.NewPOSTTask(VacuumPath, url.Values{
+		"name":  {name},
+		"merge": {merge},
+		"queue": {queue},
+		"run":   {run},
+		"max":   {strconv.Itoa(max)},
+	})
+	t.Name = dsutil.TaskName("sharded-vacuum", name, run, max)
+	return dsutil.AddTask(ctx, t, queue)
+}
+
+func handleVacuum(w http.ResponseWriter, r *http.Request) {
+	serveVacuum(appengine.NewContext(r), w, r)
+}
+
+func serveVacuum(ctx appengine.Context, w http.ResponseWriter, r *http.Request) {
+	if !dsutil.IsTaskRequest(r) {
+		http.Error(w, "sharded: vacuum must be run from a task queue", http.StatusForbidden)
+		return
+	}
+
+	name := r.FormValue("name")
+	merge, queue, run := r.FormValue("merge"), r.FormValue("queue"), r.FormValue("run")
+	max, err := strconv.Atoi(r.FormValue("max"))
+	if name == "" || run == "" || err != nil || max < 1 {
+		// Retrying won't help, so log and drop the task
+		ctx.Errorf("sharded: invalid vacuum task: %v", r.Form)
+		return
+	}
+	fn, ok := merges[merge]
+	if !ok {
+		ctx.Errorf("sharded: vacuum %q: unknown merge function %q", name, merge)
+		return
+	}
+
+	// Merge a single shard, keeping each task short
+	s := newStored(name)
+	cfg, merged, err := s.vacuumStep(ctx, fn, 1, max)
+	if err != nil {
+		ctx.Errorf("sharded: vacuum %q: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Infof("sharded: vacuum %q: merged %d shards, %d remaining", name, merged, cfg.Max-cfg.Count)
+
+	// Queue the next step (also done when this step was already performed by
+	// an earlier attempt that failed before it could queue the next one)
+	if cfg.Max > cfg.Count {
+		if err := enqueueVacuumStep(ctx, name, merge, queue, run, cfg.Max); err != nil {
+			ctx.Errorf("sharded: vacuum %q: %v", name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package sharded
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "launchpad.net/gocheck"
+)
+
+func init() {
+	RegisterMerge("TestCounter", MergeCounter)
+}
+
+// Run a vacuum task for the given step and return the response.
+func (ctx *ShardedSuite) runVacuum(c *C, max string, fromQueue bool) *httptest.ResponseRecorder {
+	form := url.Values{"name": {"Test"}, "merge": {"TestCounter"}, "run": {"run"}, "max": {max}}
+	r, err := http.NewRequest("POST", VacuumPath, strings.NewReader(form.Encode()))
+	c.Assert(err, IsNil)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if fromQueue {
+		r.Header.Set("X-AppEngine-QueueName", "default")
+	}
+
+	w := httptest.NewRecorder()
+	serveVacuum(ctx, w, r)
+	return w
+}
+
+func (ctx *ShardedSuite) TestSharded_EnqueueVacuum(c *C) {
+	counter := NewCounter("Test", 4)
+	for i := 0; i < 20; i++ {
+		c.Assert(counter.Increment(ctx), IsNil)
+	}
+
+	s := New("Test", 2)
+	c.Check(s.EnqueueVacuum(ctx, "Unknown", ""), ErrorMatches, `sharded: unknown merge function "Unknown"`)
+	c.Check(s.EnqueueVacuum(ctx, "TestCounter", ""), IsNil)
+
+	// The stored config was updated before the tasks were queued
+	cfg, err := s.config(ctx, false)
+	c.Check(err, IsNil)
+	c.Check(cfg.Count, Equals, 2)
+	c.Check(cfg.Max, Equals, 4)
+}
+
+func (ctx *ShardedSuite) TestSharded_handleVacuum(c *C) {
+	counter := NewCounter("Test", 4)
+	for i := 0; i < 20; i++ {
+		c.Assert(counter.Increment(ctx), IsNil)
+	}
+	s := New("Test", 2)
+	c.Assert(s.EnqueueVacuum(ctx, "TestCounter", ""), IsNil)
+
+	// Each task merges a single shard
+	c.Check(ctx.runVacuum(c, "4", true).Code, Equals, http.StatusOK)
+	cfg, err := s.config(ctx, false)
+	c.Check(err, IsNil)
+	c.Check(cfg.Count, Equals, 2)
+	c.Check(cfg.Max, Equals, 3)
+
+	// A repeated task doesn't merge another one
+	c.Check(ctx.runVacuum(c, "4", true).Code, Equals, http.StatusOK)
+	cfg, err = s.config(ctx, false)
+	c.Check(err, IsNil)
+	c.Check(cfg.Max, Equals, 3)
+
+	c.Check(ctx.runVacuum(c, "3", true).Code, Equals, http.StatusOK)
+	keys, err := s.All(ctx)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 2)
+
+	value, err := NewCounter("Test", 2).Value(ctx)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, int64(20))
+}
+
+func (ctx *ShardedSuite) TestSharded_handleVacuum_notFromQueue(c *C) {
+	counter := NewCounter("Test", 4)
+	for i := 0; i < 20; i++ {
+		c.Assert(counter.Increment(ctx), IsNil)
+	}
+	s := New("Test", 2)
+	c.Assert(s.EnqueueVacuum(ctx, "TestCounter", ""), IsNil)
+
+	c.Check(ctx.runVacuum(c, "4", false).Code, Equals, http.StatusForbidden)
+	cfg, err := s.config(ctx, false)
+	c.Check(err, IsNil)
+	c.Check(cfg.Max, Equals, 4)
+}
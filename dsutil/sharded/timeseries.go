@@ -0,0 +1,217 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// Resolution is the length of time covered by a TimeSeries bucket.
+type Resolution int
+
+const (
+	Minute Resolution = iota
+	Hour
+	Day
+)
+
+// Time layout used in bucket names for each resolution.
+var layouts = [...]string{
+	Minute: "2006-01-02T15:04",
+	Hour:   "2006-01-02T15",
+	Day:    "2006-01-02",
+}
+
+// Duration returns the length of time covered by a bucket.
+func (r Resolution) Duration() time.Duration {
+	switch r {
+	case Minute:
+		return time.Minute
+	case Hour:
+		return time.Hour
+	default:
+		return 24 * time.Hour
+	}
+}
+
+// Return the start of the bucket containing t (all buckets use UTC).
+func (r Resolution) truncate(t time.Time) time.Time {
+	return t.UTC().Truncate(r.Duration())
+}
+
+var ErrNoCoarserResolution = errors.New("sharded: no coarser resolution to roll up to")
+
+// TimeSeries is a set of counters for consecutive periods of time, such as
+// signups per hour. Each period is stored in its own bucket (a Counter named
+// like "name@2006-01-02T15") and increments always go to the bucket for the
+// current period at the resolution given to NewTimeSeries.
+//
+// Old buckets can be compacted into coarser ones using Rollup (for example,
+// from a cron job), which moves the counts of each minute into the bucket for
+// its hour and deletes the original buckets.
+type TimeSeries struct {
+	name  string
+	count int
+	res   Resolution
+}
+
+// NewTimeSeries creates a new TimeSeries with the given name whose buckets
+// each spread writes over at least `count` shards.
+func NewTimeSeries(name string, count int, res Resolution) TimeSeries {
+	if name == "" {
+		panic("name is required")
+	}
+	if res < Minute || res > Day {
+		panic("sharded: invalid resolution")
+	}
+	return TimeSeries{name, count, res}
+}
+
+// Bucket returns the Counter used for the bucket of the given resolution
+// that contains t.
+func (ts TimeSeries) Bucket(res Resolution, t time.Time) Counter {
+	return NewCounter(ts.bucketName(res, res.truncate(t)), ts.count)
+}
+
+// Name of the bucket of the given resolution that starts at t.
+func (ts TimeSeries) bucketName(res Resolution, t time.Time) string {
+	return ts.name + "@" + t.Format(layouts[res])
+}
+
+// Parse a bucket name created by bucketName.
+func (ts TimeSeries) parseBucket(name string) (res Resolution, t time.Time, ok bool) {
+	if !strings.HasPrefix(name, ts.name+"@") {
+		return 0, t, false
+	}
+	suffix := name[len(ts.name)+1:]
+	for res, layout := range layouts {
+		if len(suffix) == len(layout) {
+			t, err := time.Parse(layout, suffix)
+			return Resolution(res), t, err == nil
+		}
+	}
+	return 0, t, false
+}
+
+// Increment adds one to the current bucket.
+func (ts TimeSeries) Increment(ctx appengine.Context) error {
+	return ts.IncrementBy(ctx, 1)
+}
+
+// IncrementBy adds delta (which may be negative) to the current bucket.
+func (ts TimeSeries) IncrementBy(ctx appengine.Context, delta int64) error {
+	return ts.IncrementAt(ctx, time.Now(), delta)
+}
+
+// IncrementAt adds delta to the bucket containing t (for example, to record
+// events after the fact).
+func (ts TimeSeries) IncrementAt(ctx appengine.Context, t time.Time, delta int64) error {
+	return ts.Bucket(ts.res, t).IncrementBy(ctx, delta)
+}
+
+// Sum returns the total of all buckets (of any resolution) that lie entirely
+// within [start, end). Since Rollup moves counts into coarser buckets, ranges
+// that include rolled up periods should be aligned to the coarser resolution.
+//
+// The cost is proportional to the number of possible buckets in the range, so
+// long ranges should not be queried at a fine resolution.
+func (ts TimeSeries) Sum(ctx appengine.Context, start, end time.Time) (int64, error) {
+	// Find every bucket that could exist in the range
+	var buckets []Sharded
+	for res := ts.res; res <= Day; res++ {
+		t := res.truncate(start)
+		if t.Before(start) {
+			t = t.Add(res.Duration())
+		}
+		for ; !t.Add(res.Duration()).After(end); t = t.Add(res.Duration()) {
+			buckets = append(buckets, New(ts.bucketName(res, t), ts.count))
+		}
+	}
+
+	// Read their configs (missing ones were never written to)
+	keys := make([]*datastore.Key, len(buckets))
+	for i, s := range buckets {
+		keys[i] = s.cfgKey(ctx)
+	}
+	cfgs := make([]shardConfig, len(keys))
+	if err := dsutil.IgnoreMissing(dsutil.GetMulti(ctx, keys, cfgs)); err != nil {
+		return 0, err
+	}
+
+	// Sum all shards of the buckets that exist
+	var shards []*datastore.Key
+	for i, cfg := range cfgs {
+		if err := cfg.validate(); err != nil {
+			return 0, err
+		}
+		for j := 1; j <= cfg.Max; j++ {
+			shards = append(shards, buckets[i].key(ctx, j))
+		}
+	}
+	return sumCounters(ctx, shards)
+}
+
+// Rollup moves the counts of all buckets of the given resolution that end at
+// or before `before` into the buckets of the next coarser resolution and
+// deletes the original buckets.
+//
+// Each shard is moved in its own transaction, so the total of the series is
+// correct at all times and an interrupted roll up can simply be run again.
+func (ts TimeSeries) Rollup(ctx appengine.Context, res Resolution, before time.Time) error {
+	if res >= Day {
+		return ErrNoCoarserResolution
+	}
+
+	// The ShardConfig entities of the buckets serve as the list of buckets.
+	// Bucket names share the series' prefix, so a key range query finds them.
+	q := datastore.NewQuery(kShardConfigKind).KeysOnly().
+		Filter("__key__ >=", datastore.NewKey(ctx, kShardConfigKind, ts.name+"@", 0, nil)).
+		Filter("__key__ <", datastore.NewKey(ctx, kShardConfigKind, ts.name+"A", 0, nil)) // '@' + 1
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		r, t, ok := ts.parseBucket(key.StringID())
+		if !ok || r != res || t.Add(res.Duration()).After(before) {
+			continue
+		}
+		if err := ts.rollupBucket(ctx, New(key.StringID(), ts.count), NewCounter(ts.bucketName(res+1, (res+1).truncate(t)), ts.count)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move all shards of src into dst and then delete src.
+func (ts TimeSeries) rollupBucket(ctx appengine.Context, src Sharded, dst Counter) error {
+	shards, err := src.All(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		err := dst.s.UpdateRand(ctx, func(ctx appengine.Context, key *datastore.Key) error {
+			return MergeCounter(ctx, shard, key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Remove the config (and any markers left by Vacuum)
+	keys := []*datastore.Key{src.cfgKey(ctx)}
+	for _, shard := range shards {
+		keys = append(keys, retiredKey(ctx, shard))
+	}
+	if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return err
+	}
+	src.uncache(ctx)
+	return nil
+}
@@ -0,0 +1,51 @@
+package sharded
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *ShardedSuite) TestTimeSeries_Bucket_name(c *C) {
+	ts := NewTimeSeries("Test", 2, Hour)
+	t := time.Date(2026, 10, 17, 10, 42, 0, 0, time.UTC)
+	c.Check(ts.Bucket(Minute, t).Sharded().Name(), Equals, "Test@2026-10-17T10:42")
+	c.Check(ts.Bucket(Hour, t).Sharded().Name(), Equals, "Test@2026-10-17T10")
+	c.Check(ts.Bucket(Day, t).Sharded().Name(), Equals, "Test@2026-10-17")
+
+	res, start, ok := ts.parseBucket("Test@2026-10-17T10")
+	c.Check(ok, Equals, true)
+	c.Check(res, Equals, Hour)
+	c.Check(start.Equal(time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)), Equals, true)
+}
+
+func (ctx *ShardedSuite) TestTimeSeries_Sum_rollup(c *C) {
+	ts := NewTimeSeries("Test", 2, Minute)
+	day := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	for _, minute := range []int{5, 6, 6, 65, 125} {
+		t := day.Add(time.Duration(minute) * time.Minute)
+		c.Assert(ts.IncrementAt(ctx, t, 1), IsNil)
+	}
+
+	sum := func(start, end time.Duration) int64 {
+		total, err := ts.Sum(ctx, day.Add(start), day.Add(end))
+		c.Assert(err, IsNil)
+		return total
+	}
+	c.Check(sum(0, 24*time.Hour), Equals, int64(5))
+	c.Check(sum(6*time.Minute, 2*time.Hour), Equals, int64(3))
+
+	// Roll up the first two hours, only whole hours can be queried now
+	c.Assert(ts.Rollup(ctx, Minute, day.Add(2*time.Hour)), IsNil)
+	c.Check(sum(0, 24*time.Hour), Equals, int64(5))
+	c.Check(sum(0, time.Hour), Equals, int64(3))
+	c.Check(sum(6*time.Minute, 2*time.Hour), Equals, int64(1))
+	c.Check(sum(2*time.Hour, 3*time.Hour), Equals, int64(1))
+
+	// Roll up into days
+	c.Assert(ts.Rollup(ctx, Minute, day.Add(24*time.Hour)), IsNil)
+	c.Assert(ts.Rollup(ctx, Hour, day.Add(24*time.Hour)), IsNil)
+	c.Check(sum(0, time.Hour), Equals, int64(0))
+	c.Check(sum(0, 24*time.Hour), Equals, int64(5))
+	c.Check(ts.Rollup(ctx, Day, day), Equals, ErrNoCoarserResolution)
+}
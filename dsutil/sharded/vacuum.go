@@ -0,0 +1,132 @@
+package sharded
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"time"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// Largest number of shards that can be merged in a single transaction. Each
+// merge uses the entity groups of its source and destination shards and the
+// config entity is in a group of its own.
+const kMaxVacuumBatch = (dsutil.MaxEntityGroups - 1) / 2
+
+// VacuumOptions controls the behavior of VacuumBatch.
+type VacuumOptions struct {
+	// Maximum number of shards to merge in each transaction. Defaults to (and
+	// is limited by) the number of shard pairs that fit into a single
+	// cross-group transaction.
+	BatchSize int
+
+	// If set, Progress is called after each transaction commits with the
+	// number of shards merged so far by this call and the number that still
+	// need to be merged. Returning false stops the vacuum early.
+	Progress func(merged, remaining int) bool
+}
+
+// VacuumBatch is like Vacuum, but merges up to opts.BatchSize shards in each
+// transaction. Shards are merged directly into shards that are still in use,
+// and a batch never writes to the same shard twice, so the merge function
+// never sees the same `dst` twice within one transaction (reads in a
+// transaction don't observe its own writes). Batches may be smaller than
+// requested because of this.
+//
+// Progress is stored in the config after every transaction, so a run that is
+// stopped early (by the Progress callback, a request deadline, or an error)
+// can be resumed by simply calling VacuumBatch again.
+func (s Sharded) VacuumBatch(ctx appengine.Context, merge MergeFunc, opts VacuumOptions) error {
+	size := opts.BatchSize
+	if size < 1 || size > kMaxVacuumBatch {
+		size = kMaxVacuumBatch
+	}
+
+	total := 0
+	for {
+		cfg, merged, err := s.vacuumStep(ctx, merge, size, 0)
+		if err != nil {
+			return err
+		}
+		total += merged
+		remaining := cfg.Max - cfg.Count
+
+		if merged > 0 && opts.Progress != nil && !opts.Progress(total, remaining) {
+			return nil
+		}
+		if remaining <= 0 {
+			return nil
+		}
+	}
+}
+
+// Merge up to `size` of the highest numbered shards in a single transaction
+// and return the resulting config and the number of shards that were merged.
+// If `expect` is non-zero, nothing is merged unless it matches the current
+// value of Max.
+func (s Sharded) vacuumStep(ctx appengine.Context, merge MergeFunc, size, expect int) (cfg shardConfig, merged int, err error) {
+	start := time.Now()
+	err = dsutil.RunInTransaction(ctx, func(ctx appengine.Context) (err error) {
+		merged = 0
+
+		// Get the shard config
+		cfg, err = s.config(ctx, true)
+		if err != nil {
+			return err
+		}
+		if expect != 0 && cfg.Max != expect {
+			return nil // this step was already done
+		}
+
+		// Merge the last shards into shards that are still in use. A shard
+		// that has already been written to in this transaction can't be used
+		// again, since reads in a transaction don't observe its own writes.
+		written := map[int]bool{}
+		for merged < size && cfg.Max-merged > cfg.Count {
+			i := cfg.Max - merged
+			j := vacuumTarget(i, cfg.Count)
+			if written[j] {
+				break
+			}
+			written[j] = true
+
+			src, dst := s.key(ctx, i), s.key(ctx, j)
+			if err := merge(ctx, src, dst); err != nil {
+				return err
+			}
+
+			// Stop writes that use a stale cached config (see Rand)
+			if err := retire(ctx, src); err != nil {
+				return err
+			}
+			merged++
+		}
+		if merged == 0 {
+			return nil // nothing to merge
+		}
+
+		// Decrement the max value (remembering how far down data was merged
+		// for Locate) and save
+		cfg.Max -= merged
+		if cfg.Floor == 0 || cfg.Count < cfg.Floor {
+			cfg.Floor = cfg.Count
+		}
+		if _, err := datastore.Put(ctx, s.cfgKey(ctx), &cfg); err != nil {
+			return err
+		}
+		s.uncache(ctx)
+		return nil
+	})
+	if err == nil && merged > 0 {
+		// Invalidate the cache again, now that the change is committed. Once
+		// that has succeeded, the retired markers are no longer needed.
+		if s.uncache(ctx) == nil {
+			s.unretireMerged(ctx, cfg.Max+1, merged)
+		}
+		if s.stats {
+			s.recordMerges(ctx, cfg.Max+1, merged, time.Since(start))
+			flushDueStats(ctx)
+		}
+	}
+	return cfg, merged, err
+}
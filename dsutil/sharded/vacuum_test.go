@@ -0,0 +1,45 @@
+package sharded
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *ShardedSuite) TestSharded_VacuumBatch_resume(c *C) {
+	counter := NewCounter("Test", 12)
+	for i := 0; i < 30; i++ {
+		c.Assert(counter.Increment(ctx), IsNil)
+	}
+
+	// Stop after the first batch (which can only merge two shards if they
+	// are merged into different ones)
+	c.Assert(vacuumTarget(12, 6), Not(Equals), vacuumTarget(11, 6))
+	s := New("Test", 6)
+	calls := 0
+	err := s.VacuumBatch(ctx, MergeCounter, VacuumOptions{
+		BatchSize: 2,
+		Progress: func(merged, remaining int) bool {
+			calls++
+			c.Check(merged, Equals, 2)
+			c.Check(remaining, Equals, 4)
+			return false
+		},
+	})
+	c.Check(err, IsNil)
+	c.Check(calls, Equals, 1)
+
+	keys, err := s.All(ctx)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 10)
+
+	// Resume and run to completion
+	err = s.VacuumBatch(ctx, MergeCounter, VacuumOptions{})
+	c.Check(err, IsNil)
+
+	keys, err = s.All(ctx)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 6)
+
+	value, err := NewCounter("Test", 6).Value(ctx)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, int64(30))
+}
@@ -0,0 +1,43 @@
+package dsutil
+
+import (
+	"appengine"
+	"appengine/taskqueue"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+)
+
+// IsTaskRequest tests if the request was made by the task queue. App Engine
+// removes X-AppEngine-* headers from external requests, so handlers for tasks
+// can use this to reject requests made by users.
+func IsTaskRequest(r *http.Request) bool {
+	return r.Header.Get("X-AppEngine-QueueName") != ""
+}
+
+// IsCronRequest tests if the request was made by cron (see IsTaskRequest).
+func IsCronRequest(r *http.Request) bool {
+	return r.Header.Get("X-AppEngine-Cron") == "true"
+}
+
+// TaskName creates a name for one step of a chain of tasks. Task names may
+// only use [a-zA-Z0-9_-], so `name` (for example the name of the entity the
+// tasks work on) is replaced by a hash, while `prefix` and `run` are used as
+// is and must only contain those characters.
+func TaskName(prefix, name, run string, step int) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("%s-%08x-%s-%d", prefix, h.Sum32(), run, step)
+}
+
+// AddTask is a wrapper around taskqueue.Add that ignores
+// taskqueue.ErrTaskAlreadyAdded. Together with named tasks (see TaskName) this
+// lets a retried task queue the next step of a chain without the risk of
+// starting a second chain.
+func AddTask(ctx appengine.Context, t *taskqueue.Task, queue string) error {
+	_, err := taskqueue.Add(ctx, t, queue)
+	if err == taskqueue.ErrTaskAlreadyAdded {
+		err = nil // this step is already queued (or done)
+	}
+	return err
+}
@@ -8,6 +8,10 @@ import (
 
 var defaultOpts = &datastore.TransactionOptions{XG: true}
 
+// MaxEntityGroups is the largest number of entity groups that may be used in
+// a single cross-group transaction (reads count as well as writes).
+const MaxEntityGroups = 5
+
 // RunInTransaction is a wrapper around datastore.RunInTransaction that passes
 // a default datastore.TransactionOptions object with XG set to true.
 //
@@ -21,6 +25,20 @@ func RunInTransaction(ctx appengine.Context, f func(appengine.Context) error) er
 	return datastore.RunInTransaction(ctx, f, defaultOpts)
 }
 
+// JoinTransaction calls f directly if ctx is already a transaction (see
+// IsInTransaction) or in a new transaction (see RunInTransaction) otherwise.
+// This lets functions that need a transaction also be used as one step of a
+// larger transaction, in which case f's changes are only committed (and f is
+// only retried) along with the rest of the enclosing transaction. Note that f
+// doesn't see the writes made earlier in the enclosing transaction, since
+// reads in a transaction return the entities as they were when it started.
+func JoinTransaction(ctx appengine.Context, f func(appengine.Context) error) error {
+	if IsInTransaction(ctx) {
+		return f(ctx)
+	}
+	return RunInTransaction(ctx, f)
+}
+
 // IsInTransaction tests if the given transaction was one created by a call
 // to datastore.RunInTransaction (or a wrapper like the one above).
 //
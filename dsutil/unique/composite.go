@@ -0,0 +1,159 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var ErrInvalidComponent = errors.New("unique: invalid composite index component")
+
+// CompositeIndex is an index whose values are tuples of components, such as
+// (tenant, slug). Components can be strings, integers (int or int64, returned
+// as int64), bools and *datastore.Keys.
+//
+// Each tuple is encoded into a single Index value: every component is a type
+// tag followed by its (escaped) value and a terminating "/", so different
+// tuples always have different encodings, e.g. ("a/b", "c") is `sa\/b/sc/`
+// and ("a", "b/c") is `sa/sb\/c/`.
+type CompositeIndex struct {
+	idx Index
+}
+
+// NewCompositeIndex creates a composite index (see NewIndex). Normalizers are
+// not supported since they would apply to the encoded tuple.
+func NewCompositeIndex(name string, flags Flag) CompositeIndex {
+	return CompositeIndex{NewIndex(name, flags)}
+}
+
+// Index returns the underlying Index, whose values are encoded tuples.
+func (ci CompositeIndex) Index() Index {
+	return ci.idx
+}
+
+// Set maps the tuple to id (see Index.Set).
+func (ci CompositeIndex) Set(ctx appengine.Context, id string, components ...interface{}) error {
+	value, err := encodeComponents(components)
+	if err != nil {
+		return err
+	}
+	return ci.idx.Set(ctx, id, value)
+}
+
+// GetId returns the id that has the given tuple (see Index.GetId).
+func (ci CompositeIndex) GetId(ctx appengine.Context, components ...interface{}) (string, error) {
+	value, err := encodeComponents(components)
+	if err != nil {
+		return "", err
+	}
+	return ci.idx.GetId(ctx, value)
+}
+
+// GetComponents returns the tuple that id currently has.
+func (ci CompositeIndex) GetComponents(ctx appengine.Context, id string) ([]interface{}, error) {
+	value, err := ci.idx.GetValue(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeComponents(value)
+}
+
+// DeleteId removes id and its tuple from the index (see Index.DeleteId).
+func (ci CompositeIndex) DeleteId(ctx appengine.Context, id string) error {
+	return ci.idx.DeleteId(ctx, id)
+}
+
+// Type tags of the encoded components.
+const (
+	tagString = 's'
+	tagInt    = 'i'
+	tagBool   = 'b'
+	tagKey    = 'k'
+)
+
+// Encode a tuple (see CompositeIndex).
+func encodeComponents(components []interface{}) (string, error) {
+	if len(components) == 0 {
+		return "", ErrInvalidComponent
+	}
+
+	var b []byte
+	for _, c := range components {
+		switch v := c.(type) {
+		case string:
+			b = append(b, tagString)
+			for i := 0; i < len(v); i++ {
+				if v[i] == '\\' || v[i] == '/' {
+					b = append(b, '\\')
+				}
+				b = append(b, v[i])
+			}
+		case int:
+			b = strconv.AppendInt(append(b, tagInt), int64(v), 10)
+		case int64:
+			b = strconv.AppendInt(append(b, tagInt), v, 10)
+		case bool:
+			b = strconv.AppendBool(append(b, tagBool), v)
+		case *datastore.Key:
+			if v == nil {
+				return "", ErrInvalidComponent
+			}
+			b = append(append(b, tagKey), v.Encode()...) // URL-safe, so no '/'
+		default:
+			return "", fmt.Errorf("unique: unsupported composite index component type %T", c)
+		}
+		b = append(b, '/')
+	}
+	return string(b), nil
+}
+
+// Decode a tuple encoded by encodeComponents.
+func decodeComponents(value string) ([]interface{}, error) {
+	var components []interface{}
+	for len(value) > 0 {
+		tag := value[0]
+
+		// Find the end of the component, unescaping strings
+		var b []byte
+		i := 1
+		for ; i < len(value) && value[i] != '/'; i++ {
+			if value[i] == '\\' && tag == tagString && i+1 < len(value) {
+				i++
+			}
+			b = append(b, value[i])
+		}
+		if i == len(value) {
+			return nil, ErrInvalidComponent // no terminator
+		}
+		value = value[i+1:]
+
+		s := string(b)
+		switch tag {
+		case tagString:
+			components = append(components, s)
+		case tagInt:
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, ErrInvalidComponent
+			}
+			components = append(components, n)
+		case tagBool:
+			v, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, ErrInvalidComponent
+			}
+			components = append(components, v)
+		case tagKey:
+			key, err := datastore.DecodeKey(s)
+			if err != nil {
+				return nil, ErrInvalidComponent
+			}
+			components = append(components, key)
+		default:
+			return nil, ErrInvalidComponent
+		}
+	}
+	return components, nil
+}
@@ -0,0 +1,51 @@
+package unique
+
+import (
+	"appengine/datastore"
+
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *IndexSuite) TestCompositeIndex_encoding(c *C) {
+	a, err := encodeComponents([]interface{}{"a/b", "c"})
+	c.Check(err, IsNil)
+	b, err := encodeComponents([]interface{}{"a", "b/c"})
+	c.Check(err, IsNil)
+	c.Check(a, Equals, `sa\/b/sc/`)
+	c.Check(b, Equals, `sa/sb\/c/`)
+
+	// Types are part of the encoding
+	s, _ := encodeComponents([]interface{}{"1"})
+	i, _ := encodeComponents([]interface{}{1})
+	c.Check(s, Not(Equals), i)
+
+	key := datastore.NewKey(ctx, "Tenant", "t", 0, nil)
+	components := []interface{}{`a\/b\`, "", int64(-42), true, key}
+	value, err := encodeComponents(components)
+	c.Assert(err, IsNil)
+	decoded, err := decodeComponents(value)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, HasLen, 5)
+	c.Check(decoded[:4], DeepEquals, components[:4])
+	c.Check(decoded[4].(*datastore.Key).Equal(key), Equals, true)
+
+	_, err = encodeComponents([]interface{}{1.5})
+	c.Check(err, NotNil)
+	_, err = decodeComponents("sa")
+	c.Check(err, Equals, ErrInvalidComponent)
+}
+
+func (ctx *IndexSuite) TestCompositeIndex_Set(c *C) {
+	ci := NewCompositeIndex("Test", 0)
+	c.Assert(ci.Set(ctx, "id1", "a/b", "c"), IsNil)
+	c.Assert(ci.Set(ctx, "id2", "a", "b/c"), IsNil)
+	c.Check(ci.Set(ctx, "id3", "a", "b/c"), Equals, ErrDuplicateIndexValue)
+
+	id, err := ci.GetId(ctx, "a/b", "c")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+
+	components, err := ci.GetComponents(ctx, "id2")
+	c.Check(err, IsNil)
+	c.Check(components, DeepEquals, []interface{}{"a", "b/c"})
+}
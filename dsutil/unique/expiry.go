@@ -0,0 +1,287 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// WithOldValueExpiry returns a copy of idx that keeps old values (see
+// SaveOldValues, which it implies) from being reused by other ids until they
+// have been old for the given duration. Expired old values can be reused (and
+// deleted by Sweep) unless PreventReuse is set. Old values are given a
+// retirement time whenever SaveOldValues is set, but those saved by earlier
+// versions of this package don't have one: they are treated as expired, but
+// Sweep doesn't find them (they are deleted when another id reuses them).
+func (idx Index) WithOldValueExpiry(d time.Duration) Index {
+	idx.flags |= SaveOldValues
+	idx.expiry = d
+	return idx
+}
+
+// Record when the old value of id was replaced (if it still belongs to id).
+func (idx Index) retire(ctx appengine.Context, key *datastore.Key, value, id string) error {
+	props, err := idx.loadValue(ctx, key, value)
+	if err == datastore.ErrNoSuchEntity || err == ErrHashCollision {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if props.id != id || props.token != "" {
+		return nil
+	}
+
+	props.retired, props.ids = time.Now(), idx.ids
+	_, err = datastore.Put(ctx, key, props)
+	return err
+}
+
+// Sweep deletes old values that have expired (see WithOldValueExpiry) and
+// reservations that have expired (see Reserve), up to `limit` of each kind per
+// call, starting at the given cursor ("" for the first call). It returns the
+// number of entities deleted and a cursor for the next call ("" once there are
+// no more). Only old values with a retirement time are found (see
+// WithOldValueExpiry), and they are never deleted if PreventReuse is set,
+// since they are then kept forever.
+func (idx Index) Sweep(ctx appengine.Context, cursor string, limit int) (int, string, error) {
+	deleted := 0
+
+	if !strings.HasPrefix(cursor, kSweepReservations) {
+		if idx.expiry > 0 && idx.flags&PreventReuse == 0 {
+			// Values that were retired early enough (this doesn't need an
+			// ancestor since the kind is specific to the index)
+			q := datastore.NewQuery(idx.name+valueEntity).
+				Filter(retiredPropName+" <", time.Now().Add(-idx.expiry))
+			n, next, err := idx.sweepQuery(ctx, q, strings.TrimPrefix(cursor, kSweepValues), limit, idx.sweep)
+			deleted += n
+			if err != nil || next != "" {
+				return deleted, kSweepValues + next, err
+			}
+		}
+		cursor = ""
+	}
+
+	// Reservations that have expired
+	q := datastore.NewQuery(idx.name+reservationEntity).
+		Filter(expiresPropName+" <", time.Now())
+	n, next, err := idx.sweepQuery(ctx, q, strings.TrimPrefix(cursor, kSweepReservations), limit, func(ctx appengine.Context, key *datastore.Key) (bool, error) {
+		return idx.release(ctx, key, true)
+	})
+	deleted += n
+	if err != nil || next == "" {
+		return deleted, "", err
+	}
+	return deleted, kSweepReservations + next, nil
+}
+
+// Prefixes of the cursors returned by Sweep, which sweeps each kind in turn.
+const (
+	kSweepValues       = "V:"
+	kSweepReservations = "R:"
+)
+
+// Run a Sweep query and call `sweep` for each of the keys it returns, in
+// batches of transactions. Returns the number of keys `sweep` deleted and a
+// cursor for the rest of the query ("" if it was completed).
+func (idx Index) sweepQuery(ctx appengine.Context, q *datastore.Query, cursor string, limit int,
+	sweep func(appengine.Context, *datastore.Key) (bool, error)) (int, string, error) {
+	q = q.KeysOnly()
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return 0, "", err
+		}
+		q = q.Start(c)
+	}
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var keys []*datastore.Key
+	t := q.Run(ctx)
+	for {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return 0, "", err
+		}
+		keys = append(keys, key)
+	}
+	next := ""
+	if limit > 0 && len(keys) == limit {
+		c, err := t.Cursor()
+		if err != nil {
+			return 0, "", err
+		}
+		next = c.String()
+	}
+
+	// Delete them in batches, checking that each one has still expired (each
+	// uses 2 entity groups: an old value and its id, or a reservation and
+	// its value)
+	size := kMaxSetBatch
+	if idx.flags&SingleEntityGroup == 0 {
+		size = dsutil.MaxEntityGroups / 2
+	}
+	deleted := 0
+	for i := 0; i < len(keys); i += size {
+		j := i + size
+		if j > len(keys) {
+			j = len(keys)
+		}
+
+		n := 0
+		err := dsutil.RunInTransaction(ctx, func(ctx appengine.Context) error {
+			n = 0
+			for _, key := range keys[i:j] {
+				ok, err := sweep(ctx, key)
+				if err != nil {
+					return err
+				}
+				if ok {
+					n++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, "", err
+		}
+		deleted += n
+	}
+	return deleted, next, nil
+}
+
+// Delete a V entity in the current transaction if it is an expired old value.
+func (idx Index) sweep(ctx appengine.Context, key *datastore.Key) (bool, error) {
+	props := new(valueProps)
+	if err := datastore.Get(ctx, key, props); err == datastore.ErrNoSuchEntity {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if props.retired.IsZero() || time.Since(props.retired) < idx.expiry || props.token != "" {
+		return false, nil
+	}
+
+	// Make sure it isn't the current value of its id again
+	canonical, err := get(ctx, idx.newKey(ctx, idEntity, props.id))
+	if err == nil && idx.valueKey(ctx, canonical).Equal(key) {
+		return false, nil
+	} else if err != nil && err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+	return true, datastore.Delete(ctx, key)
+}
+
+// SweepPath is the URL path that SweepHandler should be mapped to:
+//
+//	http.Handle(unique.SweepPath, unique.SweepHandler)
+const SweepPath = "/_ah/unique/sweep"
+
+// SweepHandler starts EnqueueSweep for the registered index (see Register)
+// named by the "name" parameter (using the queue named by the "queue"
+// parameter, if any) and runs the tasks it queues. It is meant to be run
+// periodically from cron.yaml, for example:
+//
+//	cron:
+//	- url: /_ah/unique/sweep?name=Username
+//	  schedule: every 24 hours
+//
+// Requests that weren't made by cron (or the task queue) are rejected.
+var SweepHandler http.Handler = http.HandlerFunc(handleSweep)
+
+// EnqueueSweep starts deleting the expired old values and reservations of the
+// index in the background using a chain of tasks on the given queue ("" for
+// the default queue), each of which calls Sweep for one batch. The index must
+// be registered (see Register).
+func (idx Index) EnqueueSweep(ctx appengine.Context, queue string) error {
+	if _, ok := indexes[idx.name]; !ok {
+		return fmt.Errorf("unique: index %q is not registered", idx.name)
+	}
+
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+	return enqueueSweepStep(ctx, idx.name, queue, run, 0, "")
+}
+
+// Queue the task that continues sweeping from `cursor`.
+func enqueueSweepStep(ctx appengine.Context, name, queue, run string, step int, cursor string) error {
+	t := taskqueue.NewPOSTTask(SweepPath, url.Values{
+		"name":   {name},
+		"queue":  {queue},
+		"run":    {run},
+		"step":   {strconv.Itoa(step)},
+		"cursor": {cursor},
+	})
+	t.Name = dsutil.TaskName("unique-sweep", name, run, step)
+	return dsutil.AddTask(ctx, t, queue)
+}
+
+func handleSweep(w http.ResponseWriter, r *http.Request) {
+	serveSweep(appengine.NewContext(r), w, r)
+}
+
+func serveSweep(ctx appengine.Context, w http.ResponseWriter, r *http.Request) {
+	name, queue := r.FormValue("name"), r.FormValue("queue")
+	switch {
+	case dsutil.IsTaskRequest(r):
+		// A step of the chain
+	case dsutil.IsCronRequest(r):
+		// Start a new chain
+		idx, ok := indexes[name]
+		if !ok {
+			ctx.Errorf("unique: sweep %q: index is not registered", name)
+			http.Error(w, "unknown index", http.StatusBadRequest)
+			return
+		}
+		if err := idx.EnqueueSweep(ctx, queue); err != nil {
+			ctx.Errorf("unique: sweep %q: %v", name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	default:
+		http.Error(w, "unique: sweep must be run from cron", http.StatusForbidden)
+		return
+	}
+
+	run, cursor := r.FormValue("run"), r.FormValue("cursor")
+	step, err := strconv.Atoi(r.FormValue("step"))
+	if name == "" || run == "" || err != nil {
+		// Retrying won't help, so log and drop the task
+		ctx.Errorf("unique: invalid sweep task: %v", r.Form)
+		return
+	}
+	idx, ok := indexes[name]
+	if !ok {
+		ctx.Errorf("unique: sweep %q: index is not registered", name)
+		return
+	}
+
+	n, next, err := idx.Sweep(ctx, cursor, kVerifyBatch)
+	if n > 0 {
+		ctx.Infof("unique: sweep %q: deleted %d expired entities", name, n)
+	}
+	if err != nil {
+		ctx.Errorf("unique: sweep %q: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if next == "" {
+		ctx.Infof("unique: sweep %q: done", name)
+		return
+	}
+	if err := enqueueSweepStep(ctx, name, queue, run, step+1, next); err != nil {
+		ctx.Errorf("unique: sweep %q: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,132 @@
+package unique
+
+import (
+	"appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	. "github.com/chippydip/gaege/testing"
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *IndexSuite) TestIndex_WithOldValueExpiry(c *C) {
+	idx := NewIndex("Test", 0).WithOldValueExpiry(time.Hour)
+	c.Assert(idx.Set(ctx, "id1", "a"), IsNil)
+	c.Assert(idx.Set(ctx, "id1", "b"), IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 3)
+
+	// The old value is kept from reuse
+	c.Check(idx.Set(ctx, "id2", "a"), Equals, ErrDuplicateIndexValue)
+	id, err := idx.GetId(ctx, "a")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+
+	// But the id that had it can take it back
+	c.Check(idx.Set(ctx, "id1", "a"), IsNil)
+	c.Check(idx.Set(ctx, "id2", "b"), Equals, ErrDuplicateIndexValue)
+
+	// Until it expires
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("TestV", "b"),
+		"$":       "id1",
+		"$r":      time.Now().Add(-2 * time.Hour),
+	})
+	c.Check(idx.Set(ctx, "id2", "b"), IsNil)
+}
+
+func (ctx *IndexSuite) TestIndex_Sweep(c *C) {
+	idx := NewIndex("Test", 0).WithOldValueExpiry(time.Hour)
+	c.Assert(idx.Set(ctx, "id1", "c"), IsNil)
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("TestV", "a"), // expired
+		"$":       "id1",
+		"$r":      time.Now().Add(-2 * time.Hour),
+	}, Entity{
+		"__key__": ctx.Key("TestV", "b"), // not expired yet
+		"$":       "id1",
+		"$r":      time.Now().Add(-time.Minute),
+	}, Entity{
+		"__key__": ctx.Key("TestV", "d"), // no retirement time
+		"$":       "id2",
+	})
+
+	n, cursor, err := idx.Sweep(ctx, "", 0)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 1)
+	c.Check(cursor, Equals, "")
+	c.Check(ctx.GetAll(c), HasLen, 4)
+
+	// Old values are kept forever with PreventReuse
+	idx = NewIndex("Test", PreventReuse).WithOldValueExpiry(time.Minute)
+	n, _, err = idx.Sweep(ctx, "", 0)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 0)
+}
+
+func (ctx *IndexSuite) TestIndex_DeleteId_withOldValueExpiry(c *C) {
+	idx := NewIndex("Test", 0).WithOldValueExpiry(time.Hour)
+	c.Assert(idx.Set(ctx, "id1", "a"), IsNil)
+	c.Assert(idx.DeleteId(ctx, "id1"), IsNil)
+
+	// The value is kept as an old value
+	_, err := idx.GetId(ctx, "a")
+	c.Check(err, Equals, datastore.ErrNoSuchEntity)
+	c.Check(idx.Set(ctx, "id2", "a"), Equals, ErrDuplicateIndexValue)
+	stored := ctx.GetAll(c)[ctx.Key("TestV", "a").Encode()]
+	c.Check(stored["$r"], FitsTypeOf, time.Time{})
+
+	// Until Sweep deletes it
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("TestV", "a"),
+		"$":       "id1",
+		"$r":      time.Now().Add(-2 * time.Hour),
+	})
+	n, _, err := idx.Sweep(ctx, "", 0)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 1)
+	c.Check(ctx.GetAll(c), HasLen, 0)
+}
+
+func init() {
+	Register(NewIndex("TestSweep", 0).WithOldValueExpiry(time.Hour))
+}
+
+// Run a sweep request with the given header set and return the status code.
+func (ctx *IndexSuite) runSweep(c *C, header, value string, form url.Values) int {
+	r, err := http.NewRequest("POST", SweepPath, strings.NewReader(form.Encode()))
+	c.Assert(err, IsNil)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if header != "" {
+		r.Header.Set(header, value)
+	}
+
+	w := httptest.NewRecorder()
+	serveSweep(ctx, w, r)
+	return w.Code
+}
+
+func (ctx *IndexSuite) TestIndex_handleSweep(c *C) {
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("TestSweepV", "a"),
+		"$":       "id1",
+		"$r":      time.Now().Add(-2 * time.Hour),
+	})
+
+	// Cron only starts the chain of tasks
+	code := ctx.runSweep(c, "X-AppEngine-Cron", "true", url.Values{"name": {"TestSweep"}})
+	c.Check(code, Equals, http.StatusOK)
+	c.Check(ctx.GetAll(c), HasLen, 1)
+
+	code = ctx.runSweep(c, "X-AppEngine-QueueName", "default",
+		url.Values{"name": {"TestSweep"}, "run": {"run"}, "step": {"0"}})
+	c.Check(code, Equals, http.StatusOK)
+	c.Check(ctx.GetAll(c), HasLen, 0)
+}
+
+func (ctx *IndexSuite) TestIndex_handleSweep_notFromCron(c *C) {
+	code := ctx.runSweep(c, "", "", url.Values{"name": {"TestSweep"}})
+	c.Check(code, Equals, http.StatusForbidden)
+}
@@ -0,0 +1,87 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"unicode/utf8"
+)
+
+var (
+	ErrValueTooLong  = errors.New("unique: value is too long (see HashLongValues)")
+	ErrHashCollision = errors.New("unique: hash collision between long values")
+)
+
+// Largest key name (in bytes) allowed by the datastore.
+const kMaxKeyName = 500
+
+// Create the key name of the V entity for a normalized value. Values that are
+// too long to be a key name are truncated and followed by a hash of the full
+// value (if HashLongValues is set). The full value is then stored in the
+// entity so lookups can detect collisions, and since key names of shorter
+// values are unchanged, existing indexes keep working when the flag is added.
+func (idx Index) keyName(value string) string {
+	if len(value) <= kMaxKeyName || idx.flags&HashLongValues == 0 {
+		return value
+	}
+
+	// Keep as much of the value as possible (so prefix listings still work
+	// for shorter prefixes) without splitting a UTF-8 sequence
+	h := sha1.New()
+	h.Write([]byte(value))
+	n := kMaxKeyName - 1 - hex.EncodedLen(sha1.Size)
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	return value[:n] + "#" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Read the V entity for a value (see valueKey), checking that it really is
+// for that value.
+func (idx Index) loadValue(ctx appengine.Context, key *datastore.Key, value string) (*valueProps, error) {
+	props := new(valueProps)
+	if err := datastore.Get(ctx, key, props); err != nil {
+		return nil, err
+	}
+	if err := idx.checkValue(key, value, props.full); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// Read the id that a value is mapped to from its V entity.
+func (idx Index) getId(ctx appengine.Context, key *datastore.Key, value string) (string, error) {
+	props, err := idx.loadValue(ctx, key, value)
+	if err != nil {
+		return "", err
+	}
+	return props.getId()
+}
+
+// Write the V entity for a value, saving the full value if the key name is a
+// hash.
+func (idx Index) putId(ctx appengine.Context, key *datastore.Key, value, id string) error {
+	_, err := datastore.Put(ctx, key, idx.newValueProps(key, value, id))
+	return err
+}
+
+func (idx Index) newValueProps(key *datastore.Key, value, id string) *valueProps {
+	full := idx.normalize(value)
+	if key.StringID() == full {
+		full = "" // the key name is enough
+	}
+	return &valueProps{id: id, full: full, ids: idx.ids}
+}
+
+// Check that the V entity with the given key and full value belongs to value.
+// Hashed key names must have a matching full value, and any other entity that
+// has one must also match (it may have a hashed name equal to a short value).
+func (idx Index) checkValue(key *datastore.Key, value, full string) error {
+	norm := idx.normalize(value)
+	if (full != "" || key.StringID() != norm) && full != norm {
+		return ErrHashCollision
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package unique
+
+import (
+	"strings"
+
+	. "github.com/chippydip/gaege/testing"
+	. "launchpad.net/gocheck"
+)
+
+var longValue = "http://example.com/" + strings.Repeat("x", 1000)
+
+func (ctx *IndexSuite) TestIndex_HashLongValues(c *C) {
+	idx := NewIndex("Test", HashLongValues)
+	c.Assert(idx.Set(ctx, "id1", longValue), IsNil)
+
+	id, err := idx.GetId(ctx, longValue)
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+
+	ids, err := idx.GetIdMulti(ctx, []string{longValue})
+	c.Check(err, IsNil)
+	c.Check(ids, DeepEquals, []string{"id1"})
+
+	values, _, err := idx.ListPrefix(ctx, "http://", "", 0)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, []Mapping{{"id1", longValue, true}})
+
+	c.Check(idx.Set(ctx, "id2", longValue), Equals, ErrDuplicateIndexValue)
+	c.Check(idx.Set(ctx, "id2", longValue+"y"), IsNil)
+
+	// Existing short values still use their own key names
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("TestV", "other"),
+		"$":       "id4",
+	})
+	idx = NewIndex("Test", HashLongValues|SaveOldValues) // don't check for failed deletes
+	id, err = idx.GetId(ctx, "other")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id4")
+}
+
+func (ctx *IndexSuite) TestIndex_HashLongValues_disabled(c *C) {
+	idx := NewIndex("Test", 0)
+	c.Check(idx.Set(ctx, "id1", longValue), Equals, ErrValueTooLong)
+}
+
+func (ctx *IndexSuite) TestIndex_HashLongValues_collision(c *C) {
+	idx := NewIndex("Test", HashLongValues|SaveOldValues)
+	name := idx.keyName(longValue)
+	c.Assert(len(name) <= kMaxKeyName, Equals, true)
+
+	// A short value that matches the hashed key name of a long one
+	c.Assert(idx.Set(ctx, "id1", name), IsNil)
+	_, err := idx.GetId(ctx, longValue)
+	c.Check(err, Equals, ErrHashCollision)
+	c.Check(idx.Set(ctx, "id2", longValue), Equals, ErrHashCollision)
+
+	// And the other way around
+	ctx.Reset(c)
+	c.Assert(idx.Set(ctx, "id1", longValue), IsNil)
+	_, err = idx.GetId(ctx, name)
+	c.Check(err, Equals, ErrHashCollision)
+}
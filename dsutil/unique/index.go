@@ -4,6 +4,7 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"errors"
+	"time"
 
 	"github.com/chippydip/gaege/dsutil"
 )
@@ -16,14 +17,21 @@ const (
 	SingleEntityGroup Flag = 1 << iota
 	SaveOldValues
 	PreventReuse
+	HashLongValues // allow values longer than a key name (see keyName)
 )
 
 type Index struct {
-	name  string
-	flags Flag
+	name   string
+	flags  Flag
+	norm   []Normalizer
+	ids    idType        // how ids are stored in V entities (see KeyIndex)
+	expiry time.Duration // how long old values are kept from reuse
 }
 
-func NewIndex(name string, flags Flag) Index {
+// NewIndex creates an index with the given name and flags. If any normalizers
+// are given, they are applied (in order) to values before checking them for
+// uniqueness. The original value is still returned by GetValue.
+func NewIndex(name string, flags Flag, norm ...Normalizer) Index {
 	if flags&PreventReuse != 0 {
 		// Preventing reuse requires saving old values
 		flags |= SaveOldValues
@@ -31,20 +39,33 @@ func NewIndex(name string, flags Flag) Index {
 	return Index{
 		name:  name,
 		flags: flags,
+		norm:  norm,
 	}
 }
 
 const (
 	idEntity    = "I" // maps IDs to Values
 	valueEntity = "V" // maps Values to IDs
+	setEntity   = "S" // maps IDs to sets of Values (see MultiValueIndex)
+
+	reservationEntity = "R" // maps reservation tokens to Values (see Reserve)
 )
 
-func (idx Index) newKey(ctx appengine.Context, kind, id string) (key *datastore.Key) {
-	if idx.flags&SingleEntityGroup != 0 {
-		key = datastore.NewKey(ctx, idx.name, "", 1, nil)
+func (idx Index) newKey(ctx appengine.Context, kind, id string) *datastore.Key {
+	return datastore.NewKey(ctx, idx.name+kind, id, 0, idx.rootKey(ctx))
+}
+
+// Create the key of the entity that maps the (normalized) value to its id
+func (idx Index) valueKey(ctx appengine.Context, value string) *datastore.Key {
+	return idx.newKey(ctx, valueEntity, idx.keyName(idx.normalize(value)))
+}
+
+// Parent of all index entities (nil unless SingleEntityGroup is set)
+func (idx Index) rootKey(ctx appengine.Context) *datastore.Key {
+	if idx.flags&SingleEntityGroup == 0 {
+		return nil
 	}
-	kind = idx.name + kind
-	return datastore.NewKey(ctx, kind, id, 0, key)
+	return datastore.NewKey(ctx, idx.name, "", 1, nil)
 }
 
 func (idx Index) GetValue(ctx appengine.Context, id string) (value string, err error) {
@@ -52,84 +73,221 @@ func (idx Index) GetValue(ctx appengine.Context, id string) (value string, err e
 }
 
 func (idx Index) GetId(ctx appengine.Context, value string) (id string, err error) {
-	key := idx.newKey(ctx, valueEntity, value)
-	id, err = get(ctx, key)
+	key := idx.valueKey(ctx, value)
+	props, err := idx.loadValue(ctx, key, value)
+	if err == nil {
+		id, err = props.getId()
+	}
+	if err != nil {
+		return "", err
+	}
 
-	// If old values were supposed to be deleted, make sure this isn't an old value
-	if err == nil && idx.flags&SaveOldValues == 0 {
+	switch {
+	case idx.flags&SaveOldValues == 0:
+		// If old values were supposed to be deleted, make sure this isn't an old value
 
 		// Get the canonical version (should be the same as value)
 		canonical, err := get(ctx, idx.newKey(ctx, idEntity, id))
-		if err != nil {
+		if err != nil && err != datastore.ErrNoSuchEntity {
 			return "", err
 		}
-		if value != canonical {
+		if err != nil || idx.normalize(value) != idx.normalize(canonical) {
 			// Yikes! This should have been deleted, so try again and return not found
 			del(ctx, key)
 			return "", datastore.ErrNoSuchEntity
 		}
+
+	default:
+		// Old values are only found while their id exists (see DeleteId),
+		// including those saved without a retirement time
+		if _, err := get(ctx, idx.newKey(ctx, idEntity, id)); err != nil {
+			return "", err
+		}
 	}
 
-	return id, err
+	return id, nil
 }
 
+// DeleteId removes id and its current value from the index, making the value
+// available to other ids. With SaveOldValues, the old values of id are no
+// longer found by GetId either, and can be reused by other ids unless
+// PreventReuse is set. With WithOldValueExpiry, the current value is kept as
+// an old value instead (so it can't be reused until it expires, and is then
+// deleted by Sweep). Deleting an id that isn't in the index is not an error.
 func (idx Index) DeleteId(ctx appengine.Context, id string) error {
-	panic("NYI")
-}
+	valueKey := idx.newKey(ctx, idEntity, id)
+
+	return dsutil.JoinTransaction(ctx, func(ctx appengine.Context) error {
+		value, err := get(ctx, valueKey)
+		if err == datastore.ErrNoSuchEntity {
+			return nil // nothing to delete
+		} else if err != nil {
+			return err
+		}
+		keys := []*datastore.Key{valueKey}
+
+		// Only delete (or retire) the canonical value if it still belongs to
+		// this id
+		idKey := idx.valueKey(ctx, value)
+		currId, err := idx.getId(ctx, idKey, value)
+		if err == nil && currId == id {
+			if idx.expiry <= 0 {
+				keys = append(keys, idKey)
+			} else if err := idx.retire(ctx, idKey, value, id); err != nil {
+				return err
+			}
+		} else if err != nil && err != datastore.ErrNoSuchEntity && err != ErrHashCollision && err != ErrReserved {
+			return err
+		}
 
-// TODO: ID/Value query methods to get all
+		// Any old values still refer to id, so they can be reused (see Set)
+		// unless PreventReuse is set
+		return datastore.DeleteMulti(ctx, keys)
+	})
+}
 
+// Set maps value to id (replacing any previous value of id), or returns
+// ErrDuplicateIndexValue if the value is already used by another id.
+//
+// Like the other methods that write to the index, Set joins the transaction
+// if ctx is one (see dsutil.JoinTransaction). This allows the index to be
+// updated atomically with other entities, as long as the transaction is a
+// cross-group one (Set uses up to 4 of the dsutil.MaxEntityGroups unless the
+// index is a SingleEntityGroup) and returns the error to roll back on failure.
+//
+// Reads in a transaction don't see its own writes, so within the caller's
+// transaction Set only sees the index as it was before the transaction began:
+// it must not be combined with other writes to the same index entries (for
+// example a Set and a DeleteId of the same id, or two Sets of the same value)
+// in one transaction. Use SetMulti to set several values in a transaction.
 func (idx Index) Set(ctx appengine.Context, id, value string) error {
+	return dsutil.JoinTransaction(ctx, func(ctx appengine.Context) error {
+		return idx.set(ctx, id, value, "", map[string]bool{})
+	})
+}
+
+// errBatchFull is returned by set if it needs a key that was already written
+// in the current transaction (reads in a transaction don't see its writes).
+var errBatchFull = errors.New("unique: batch full")
+
+// Set value for id in the current transaction. Keys that are written are
+// added to `written`, and errBatchFull is returned without making any changes
+// if any of the keys that are needed are already in it. If token is not "",
+// the value is reserved by it (and the reservation is replaced).
+func (idx Index) set(ctx appengine.Context, id, value, token string, written map[string]bool) error {
 	valueKey := idx.newKey(ctx, idEntity, id)
-	idKey := idx.newKey(ctx, valueEntity, value)
+	idKey := idx.valueKey(ctx, value)
+	if len(idKey.StringID()) > kMaxKeyName {
+		return ErrValueTooLong
+	}
+	if _, err := idx.ids.value(id); err != nil {
+		return err
+	}
+	if written[valueKey.String()] || written[idKey.String()] {
+		return errBatchFull
+	}
 
-	return dsutil.RunInTransaction(ctx, func(ctx appengine.Context) error {
-		// Check for an existing key for this value
-		if currId, err := get(ctx, idKey); err != datastore.ErrNoSuchEntity {
-			if err != nil {
-				return err // unexpected datastore problem
-			}
-			// value exist
+	// Check for an existing key for this value (which may be reserved)
+	var currId string
+	props, err := idx.loadValue(ctx, idKey, value)
+	if err == nil {
+		currId, err = props.getId()
+	}
+	if err == ErrReserved {
+		if token == "" {
+			return ErrDuplicateIndexValue
+		}
+		err = datastore.ErrNoSuchEntity // being confirmed (see Confirm)
+	}
+	if err != datastore.ErrNoSuchEntity {
+		if err != nil {
+			return err // unexpected datastore problem
+		}
+		// value exist
 
-			if currId == id {
-				return nil // already set
-			}
+		if currId != id {
 			// value is mapped to another ID
 
-			if idx.flags&PreventReuse != 0 {
-				return ErrDuplicateIndexValue
-			}
-			// value can be reused
-
-			// Check if value is canonical for currId
-			canonical, err := idx.GetValue(ctx, currId)
-			if err == nil {
-				if value == canonical {
-					return ErrDuplicateIndexValue
-				}
-			} else if err != datastore.ErrNoSuchEntity {
-				return err // unexpected datastore problem
+			if err := idx.reusable(ctx, currId, value, props.retired, written); err != nil {
+				return err
 			}
 			// value is non canonical and can be reused
-		}
-		// ok to insert/update the value
+		} else if props.retired.IsZero() {
+			if len(idx.norm) == 0 {
+				return nil // already set
+			}
 
-		// Should we try to delete the old value?
+			// already set, but the original value may be different
+			if curr, err := get(ctx, valueKey); err == nil && curr == value {
+				return nil
+			} else if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			written[valueKey.String()] = true
+			return put(ctx, valueKey, value)
+		}
+		// else an old value of id becomes its value again
+	}
+	// ok to insert/update the value
+
+	// Delete (or retire) the old value
+	var oldKey *datastore.Key
+	oldValue, err := get(ctx, valueKey)
+	if err == nil {
+		oldKey = idx.valueKey(ctx, oldValue)
+		if oldKey.Equal(idKey) {
+			oldKey = nil // same value (after normalization)
+		} else if written[oldKey.String()] {
+			return errBatchFull
+		}
+	}
+	if oldKey != nil {
+		written[oldKey.String()] = true
 		if idx.flags&SaveOldValues == 0 {
 			// Note: failure here is non-fatal since GetId will ignore
 			// (and try to delete again) any non-canonical values it may find
-			if oldValue, err := idx.GetValue(ctx, id); err == nil {
-				key := idx.newKey(ctx, valueEntity, oldValue)
-				del(ctx, key)
-			}
+			del(ctx, oldKey)
+		} else if err := idx.retire(ctx, oldKey, oldValue, id); err != nil {
+			return err
 		}
+	}
 
-		// Update the value index and then the id index
-		if err := put(ctx, idKey, id); err != nil {
-			return err
+	// Update the value index and then the id index
+	written[idKey.String()] = true
+	written[valueKey.String()] = true
+	if err := idx.putId(ctx, idKey, value, id); err != nil {
+		return err
+	}
+	return put(ctx, valueKey, value)
+}
+
+// Check if a value that currently maps to another id (and was retired at the
+// given time, see WithOldValueExpiry) can be reused.
+func (idx Index) reusable(ctx appengine.Context, currId, value string, retired time.Time, written map[string]bool) error {
+	if idx.flags&PreventReuse != 0 {
+		return ErrDuplicateIndexValue
+	}
+	// value can be reused
+
+	// Check if value is canonical for currId
+	canonicalKey := idx.newKey(ctx, idEntity, currId)
+	if written[canonicalKey.String()] {
+		return errBatchFull
+	}
+	canonical, err := get(ctx, canonicalKey)
+	if err == nil {
+		if idx.normalize(value) == idx.normalize(canonical) {
+			return ErrDuplicateIndexValue
 		}
-		return put(ctx, valueKey, value)
-	})
+	} else if err != datastore.ErrNoSuchEntity {
+		return err // unexpected datastore problem
+	}
+
+	// Old values are kept for a while before they can be reused
+	if idx.expiry > 0 && !retired.IsZero() && time.Since(retired) < idx.expiry {
+		return ErrDuplicateIndexValue
+	}
+	return nil
 }
 
 func get(ctx appengine.Context, key *datastore.Key) (prop string, err error) {
@@ -154,7 +312,7 @@ const propName = "$"
 func (pls stringPLS) Load(c <-chan datastore.Property) error {
 	for p := range c {
 		if p.Name == propName && pls.string != nil {
-			if s, ok := p.Value.(string); ok {
+			if s, ok := idString(p.Value); ok {
 				*pls.string = s
 			}
 		}
@@ -174,3 +332,91 @@ func (pls stringPLS) Save(c chan<- datastore.Property) error {
 
 	return nil
 }
+
+// valueProps implements datastore.PropertyLoadSaver for V entities, which
+// store the id the value maps to, the full (normalized) value if the key name
+// is a hash (see keyName) and any reservation (see Reserve).
+type valueProps struct {
+	id, full string
+	token    string
+	expires  time.Time
+	retired  time.Time // when the value became an old value
+
+	ids idType // how to save id
+}
+
+const (
+	fullPropName    = "$v"
+	tokenPropName   = "$t"
+	expiresPropName = "$e"
+	retiredPropName = "$r" // indexed (see Sweep)
+)
+
+func (props *valueProps) Load(c <-chan datastore.Property) error {
+	for p := range c {
+		if p.Name == propName {
+			props.id, _ = idString(p.Value)
+			continue
+		}
+
+		switch v := p.Value.(type) {
+		case string:
+			switch p.Name {
+			case fullPropName:
+				props.full = v
+			case tokenPropName:
+				props.token = v
+			}
+		case time.Time:
+			switch p.Name {
+			case expiresPropName:
+				props.expires = v
+			case retiredPropName:
+				props.retired = v
+			}
+		}
+	}
+
+	return nil
+}
+
+func (props *valueProps) Save(c chan<- datastore.Property) error {
+	defer close(c)
+
+	id, err := props.ids.value(props.id)
+	if err != nil {
+		return err
+	}
+	c <- datastore.Property{
+		Name:    propName,
+		Value:   id,
+		NoIndex: true,
+	}
+	if props.full != "" {
+		c <- datastore.Property{
+			Name:    fullPropName,
+			Value:   props.full,
+			NoIndex: true,
+		}
+	}
+	if props.token != "" {
+		c <- datastore.Property{
+			Name:    tokenPropName,
+			Value:   props.token,
+			NoIndex: true,
+		}
+		c <- datastore.Property{
+			Name:    expiresPropName,
+			Value:   props.expires,
+			NoIndex: true,
+		}
+	}
+	if !props.retired.IsZero() {
+		c <- datastore.Property{
+			Name:  retiredPropName,
+			Value: props.retired,
+		}
+	}
+
+	return nil
+}
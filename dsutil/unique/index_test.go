@@ -1,6 +1,7 @@
 package unique
 
 import (
+	"appengine"
 	"appengine/datastore"
 	"appengine/memcache"
 	"testing"
@@ -131,6 +132,119 @@ func (ctx *IndexSuite) TestIndex_Set_reuseInUse(c *C) {
 	c.Check(id, Equals, "id2")
 }
 
+func (ctx *IndexSuite) TestIndex_DeleteId_notFound(c *C) {
+	idx := NewIndex("Test", 0)
+	err := idx.DeleteId(ctx, "not-found")
+	c.Check(err, IsNil)
+}
+
+func (ctx *IndexSuite) TestIndex_DeleteId_simple(c *C) {
+	idx := NewIndex("Test", 0)
+	c.Assert(idx.Set(ctx, "id1", "oldValue"), IsNil)
+	c.Assert(idx.Set(ctx, "id1", "value"), IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 2)
+
+	err := idx.DeleteId(ctx, "id1")
+	c.Check(err, IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 0)
+
+	_, err = idx.GetValue(ctx, "id1")
+	c.Check(err, Equals, datastore.ErrNoSuchEntity)
+	_, err = idx.GetId(ctx, "value")
+	c.Check(err, Equals, datastore.ErrNoSuchEntity)
+
+	err = idx.Set(ctx, "id2", "value")
+	c.Check(err, IsNil)
+}
+
+func (ctx *IndexSuite) TestIndex_DeleteId_singleEntityGroup(c *C) {
+	idx := NewIndex("Test", SingleEntityGroup)
+	c.Assert(idx.Set(ctx, "id1", "value"), IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 2)
+
+	err := idx.DeleteId(ctx, "id1")
+	c.Check(err, IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 0)
+
+	err = idx.Set(ctx, "id2", "value")
+	c.Check(err, IsNil)
+}
+
+func (ctx *IndexSuite) TestIndex_DeleteId_saveOldValues(c *C) {
+	idx := NewIndex("Test", SaveOldValues)
+	c.Assert(idx.Set(ctx, "id1", "oldValue"), IsNil)
+	c.Assert(idx.Set(ctx, "id1", "value"), IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 3)
+
+	err := idx.DeleteId(ctx, "id1")
+	c.Check(err, IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 1) // oldValue is kept
+
+	// Both values are released
+	_, err = idx.GetId(ctx, "oldValue")
+	c.Check(err, Equals, datastore.ErrNoSuchEntity)
+	ids, err := idx.GetIdMulti(ctx, []string{"oldValue"})
+	c.Check(err, DeepEquals, appengine.MultiError{datastore.ErrNoSuchEntity})
+	c.Check(ids, DeepEquals, []string{""})
+	c.Check(idx.Set(ctx, "id2", "value"), IsNil)
+	c.Check(idx.Set(ctx, "id3", "oldValue"), IsNil)
+}
+
+func (ctx *IndexSuite) TestIndex_DeleteId_legacyOldValues(c *C) {
+	// An old value saved without a retirement time
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("TestI", "id1"),
+		"$":       "value",
+	}, Entity{
+		"__key__": ctx.Key("TestV", "value"),
+		"$":       "id1",
+	}, Entity{
+		"__key__": ctx.Key("TestV", "oldValue"),
+		"$":       "id1",
+	})
+	idx := NewIndex("Test", SaveOldValues)
+	c.Assert(idx.DeleteId(ctx, "id1"), IsNil)
+
+	_, err := idx.GetId(ctx, "oldValue")
+	c.Check(err, Equals, datastore.ErrNoSuchEntity)
+	ids, err := idx.GetIdMulti(ctx, []string{"oldValue"})
+	c.Check(err, DeepEquals, appengine.MultiError{datastore.ErrNoSuchEntity})
+	c.Check(ids, DeepEquals, []string{""})
+}
+
+func (ctx *IndexSuite) TestIndex_Set_oldValueAgain(c *C) {
+	idx := NewIndex("Test", SaveOldValues)
+	c.Assert(idx.Set(ctx, "id1", "value"), IsNil)
+	c.Assert(idx.Set(ctx, "id1", "newValue"), IsNil)
+	c.Assert(idx.Set(ctx, "id1", "value"), IsNil)
+
+	// The value is current again, so it is no longer marked as old
+	props := new(valueProps)
+	c.Assert(datastore.Get(ctx, idx.valueKey(ctx, "value"), props), IsNil)
+	c.Check(props.retired.IsZero(), Equals, true)
+	props = new(valueProps)
+	c.Assert(datastore.Get(ctx, idx.valueKey(ctx, "newValue"), props), IsNil)
+	c.Check(props.retired.IsZero(), Equals, false)
+
+	id, err := idx.GetId(ctx, "newValue")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+}
+
+func (ctx *IndexSuite) TestIndex_DeleteId_preventReuse(c *C) {
+	idx := NewIndex("Test", PreventReuse)
+	c.Assert(idx.Set(ctx, "id1", "oldValue"), IsNil)
+	c.Assert(idx.Set(ctx, "id1", "value"), IsNil)
+
+	err := idx.DeleteId(ctx, "id1")
+	c.Check(err, IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 1) // oldValue is kept
+
+	// Only the current value is released
+	c.Check(idx.Set(ctx, "id2", "value"), IsNil)
+	c.Check(idx.Set(ctx, "id3", "oldValue"), Equals, ErrDuplicateIndexValue)
+}
+
 // Memcache tests
 
 func (ctx *IndexSuite) TestIndex_GetValue_memcache(c *C) {
@@ -0,0 +1,144 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"strings"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// Mapping is a single id/value pair in an Index.
+type Mapping struct {
+	Id    string
+	Value string
+
+	// Canonical is false for old values of Id (see SaveOldValues).
+	Canonical bool
+}
+
+// ListIds returns up to `limit` ids and their current values in id order,
+// starting at the given cursor ("" for the first page). The returned cursor
+// continues the listing and is "" once there are no more results. A limit of
+// zero or less returns all remaining results.
+func (idx Index) ListIds(ctx appengine.Context, cursor string, limit int) ([]Mapping, string, error) {
+	keys, props, _, next, err := idx.list(ctx, idEntity, "", cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	mappings := make([]Mapping, len(keys))
+	for i, key := range keys {
+		mappings[i] = Mapping{key.StringID(), props[i], true}
+	}
+	return mappings, next, nil
+}
+
+// ListValues returns the values in the index in value order (see ListIds for
+// pagination). Old values are included if SaveOldValues is set. A page can
+// contain fewer than `limit` results even if there are more to come.
+//
+// If the index has normalizers, results are ordered by the normalized value
+// and only current values are returned in their original form.
+func (idx Index) ListValues(ctx appengine.Context, cursor string, limit int) ([]Mapping, string, error) {
+	return idx.ListPrefix(ctx, "", cursor, limit)
+}
+
+// ListPrefix is like ListValues but only returns values that start with the
+// given prefix (after normalization). Long values (see HashLongValues) are
+// only found by prefixes shorter than the part of them kept in the key name.
+func (idx Index) ListPrefix(ctx appengine.Context, prefix, cursor string, limit int) ([]Mapping, string, error) {
+	if prefix != "" {
+		prefix = idx.normalize(prefix)
+	}
+	keys, props, fulls, next, err := idx.list(ctx, valueEntity, prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Look up the canonical value of each id
+	idKeys := make([]*datastore.Key, len(keys))
+	dst := make([]datastore.PropertyLoadSaver, len(keys))
+	canonical := make([]string, len(keys))
+	for i := range keys {
+		idKeys[i] = idx.newKey(ctx, idEntity, props[i])
+		dst[i] = stringPLS{&canonical[i]}
+	}
+	if err := dsutil.IgnoreMissing(dsutil.GetMulti(ctx, idKeys, dst)); err != nil {
+		return nil, "", err
+	}
+
+	mappings := make([]Mapping, 0, len(keys))
+	for i, key := range keys {
+		m := Mapping{props[i], key.StringID(), false}
+		if fulls[i] != "" {
+			m.Value = fulls[i] // the key name is a hash (see keyName)
+			if !strings.HasPrefix(m.Value, prefix) {
+				continue
+			}
+		}
+		if canonical[i] != "" && idx.normalize(canonical[i]) == m.Value {
+			m.Value, m.Canonical = canonical[i], true
+		}
+
+		// Skip old values that should have been deleted (see GetId)
+		if !m.Canonical && idx.flags&SaveOldValues == 0 {
+			continue
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, next, nil
+}
+
+// Query the entities of the given kind whose key names start with prefix,
+// returning their keys and properties (the full values are only set for V
+// entities with hashed key names).
+func (idx Index) list(ctx appengine.Context, kind, prefix, cursor string, limit int) (keys []*datastore.Key, props, fulls []string, next string, err error) {
+	q := datastore.NewQuery(idx.name + kind).Order("__key__")
+	if root := idx.rootKey(ctx); root != nil {
+		q = q.Ancestor(root)
+	}
+	if prefix != "" {
+		// U+10FFFF is the largest code point, so this bounds all key names
+		// starting with prefix (except ones that continue with it)
+		q = q.Filter("__key__ >=", idx.newKey(ctx, kind, prefix)).
+			Filter("__key__ <", idx.newKey(ctx, kind, prefix+"\U0010FFFF"))
+	}
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, nil, nil, "", err
+		}
+		q = q.Start(c)
+	}
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	t := q.Run(ctx)
+	for {
+		var p valueProps
+		key, err := t.Next(&p)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, nil, nil, "", err
+		}
+		if p.token != "" {
+			continue // reserved (see Reserve)
+		}
+		keys = append(keys, key)
+		props = append(props, p.id)
+		fulls = append(fulls, p.full)
+	}
+
+	// A full page may have more results after it
+	if limit > 0 && len(keys) == limit {
+		c, err := t.Cursor()
+		if err != nil {
+			return nil, nil, nil, "", err
+		}
+		next = c.String()
+	}
+	return keys, props, fulls, next, nil
+}
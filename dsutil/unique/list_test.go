@@ -0,0 +1,63 @@
+package unique
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *IndexSuite) TestIndex_ListIds_paginated(c *C) {
+	idx := NewIndex("Test", 0)
+	c.Assert(idx.Set(ctx, "id1", "c"), IsNil)
+	c.Assert(idx.Set(ctx, "id2", "b"), IsNil)
+	c.Assert(idx.Set(ctx, "id3", "a"), IsNil)
+
+	page, cursor, err := idx.ListIds(ctx, "", 2)
+	c.Check(err, IsNil)
+	c.Check(page, DeepEquals, []Mapping{{"id1", "c", true}, {"id2", "b", true}})
+	c.Assert(cursor, Not(Equals), "")
+
+	page, cursor, err = idx.ListIds(ctx, cursor, 2)
+	c.Check(err, IsNil)
+	c.Check(page, DeepEquals, []Mapping{{"id3", "a", true}})
+	c.Check(cursor, Equals, "")
+}
+
+func (ctx *IndexSuite) TestIndex_ListValues_oldValues(c *C) {
+	for _, flags := range []Flag{0, SaveOldValues, SingleEntityGroup | SaveOldValues} {
+		ctx.Reset(c)
+		idx := NewIndex("Test", flags)
+		c.Assert(idx.Set(ctx, "id1", "a"), IsNil)
+		c.Assert(idx.Set(ctx, "id1", "b"), IsNil)
+		c.Assert(idx.Set(ctx, "id2", "c"), IsNil)
+
+		expected := []Mapping{{"id1", "b", true}, {"id2", "c", true}}
+		if flags&SaveOldValues != 0 {
+			expected = append([]Mapping{{"id1", "a", false}}, expected...)
+		}
+
+		values, cursor, err := idx.ListValues(ctx, "", 0)
+		c.Check(err, IsNil)
+		c.Check(values, DeepEquals, expected)
+		c.Check(cursor, Equals, "")
+	}
+}
+
+func (ctx *IndexSuite) TestIndex_ListPrefix(c *C) {
+	for _, flags := range []Flag{0, SingleEntityGroup} {
+		ctx.Reset(c)
+		idx := NewIndex("Test", flags)
+		c.Assert(idx.Set(ctx, "id1", "ad"), IsNil)
+		c.Assert(idx.Set(ctx, "id2", "adm"), IsNil)
+		c.Assert(idx.Set(ctx, "id3", "admin"), IsNil)
+		c.Assert(idx.Set(ctx, "id4", "admz"), IsNil)
+		c.Assert(idx.Set(ctx, "id5", "adn"), IsNil)
+
+		values, cursor, err := idx.ListPrefix(ctx, "adm", "", 2)
+		c.Check(err, IsNil)
+		c.Check(values, DeepEquals, []Mapping{{"id2", "adm", true}, {"id3", "admin", true}})
+
+		values, cursor, err = idx.ListPrefix(ctx, "adm", cursor, 2)
+		c.Check(err, IsNil)
+		c.Check(values, DeepEquals, []Mapping{{"id4", "admz", true}})
+		c.Check(cursor, Equals, "")
+	}
+}
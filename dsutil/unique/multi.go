@@ -0,0 +1,185 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+var (
+	ErrLengthMismatch = errors.New("unique: ids and values have different lengths")
+
+	// ErrConflict is returned by SetMulti (in an enclosing transaction) for
+	// entries that use the same id or value as an earlier entry.
+	ErrConflict = errors.New("unique: entry conflicts with an earlier entry in the transaction")
+)
+
+// Largest number of entries SetMulti writes in one transaction when the index
+// is in a single entity group (each entry writes up to 3 entities).
+const kMaxSetBatch = 100
+
+// GetValueMulti is a batch version of GetValue. If any ids are not found, the
+// error is an appengine.MultiError with datastore.ErrNoSuchEntity at their
+// positions (and the value is "").
+func (idx Index) GetValueMulti(ctx appengine.Context, ids []string) ([]string, error) {
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = idx.newKey(ctx, idEntity, id)
+	}
+	return getMulti(ctx, keys)
+}
+
+// GetIdMulti is a batch version of GetId. If any values are not found, the
+// error is an appengine.MultiError with datastore.ErrNoSuchEntity at their
+// positions (and the id is "").
+func (idx Index) GetIdMulti(ctx appengine.Context, values []string) ([]string, error) {
+	keys := make([]*datastore.Key, len(values))
+	props := make([]valueProps, len(values))
+	dst := make([]datastore.PropertyLoadSaver, len(values))
+	for i, value := range values {
+		keys[i] = idx.valueKey(ctx, value)
+		dst[i] = &props[i]
+	}
+	err := dsutil.GetMulti(ctx, keys, dst)
+	errs, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	} else if errs == nil {
+		errs = make(appengine.MultiError, len(keys))
+	}
+
+	// Check for hash collisions (see keyName) and reservations
+	ids := make([]string, len(values))
+	for i := range keys {
+		if errs[i] == nil {
+			if errs[i] = idx.checkValue(keys[i], values[i], props[i].full); errs[i] == nil {
+				ids[i], errs[i] = props[i].getId()
+			}
+		}
+	}
+
+	// If old values were supposed to be deleted, make sure these aren't old
+	// values, otherwise make sure the ids of old values still exist (see GetId)
+	var found []int
+	var idKeys []*datastore.Key
+	for i := range keys {
+		if errs[i] == nil {
+			found = append(found, i)
+			idKeys = append(idKeys, idx.newKey(ctx, idEntity, ids[i]))
+		}
+	}
+
+	canonical, err := getMulti(ctx, idKeys)
+	if err := dsutil.IgnoreMissing(err); err != nil {
+		return nil, err
+	}
+
+	var stale []*datastore.Key
+	for j, i := range found {
+		if idx.flags&SaveOldValues != 0 {
+			if me, ok := err.(appengine.MultiError); ok && me[j] != nil {
+				ids[i], errs[i] = "", datastore.ErrNoSuchEntity
+			}
+		} else if idx.normalize(canonical[j]) != idx.normalize(values[i]) {
+			// This should have been deleted (see GetId)
+			stale = append(stale, keys[i])
+			ids[i], errs[i] = "", datastore.ErrNoSuchEntity
+		}
+	}
+	if len(stale) > 0 {
+		datastore.DeleteMulti(ctx, stale)
+	}
+
+	return ids, multiError(errs)
+}
+
+// SetMulti is a batch version of Set that sets values[i] for ids[i]. Entries
+// are written in order, using as few transactions as the entity group limits
+// allow (so the batch as a whole is not atomic). If any entries fail, the
+// error is an appengine.MultiError with an error (such as
+// ErrDuplicateIndexValue) at their positions.
+//
+// If ctx is a transaction, all entries are written in it (see Set), so it
+// must have room for all the entity groups used.
+func (idx Index) SetMulti(ctx appengine.Context, ids, values []string) error {
+	if len(ids) != len(values) {
+		return ErrLengthMismatch
+	}
+
+	errs := make(appengine.MultiError, len(ids))
+	if dsutil.IsInTransaction(ctx) {
+		written := map[string]bool{}
+		for i := range ids {
+			err := idx.set(ctx, ids[i], values[i], "", written)
+			if err == errBatchFull {
+				err = ErrConflict // can't wait for the next transaction
+			} else if err != nil && err != ErrDuplicateIndexValue {
+				return err
+			}
+			errs[i] = err
+		}
+		return multiError(errs)
+	}
+
+	size := kMaxSetBatch
+	if idx.flags&SingleEntityGroup == 0 {
+		// Each entry uses up to 4 entity groups: its id and value, the id
+		// that currently has the value and its own old value
+		size = dsutil.MaxEntityGroups / 4
+	}
+
+	for i := 0; i < len(ids); {
+		n, failed := 0, false
+		err := dsutil.RunInTransaction(ctx, func(ctx appengine.Context) error {
+			n, failed = 0, false
+			written := map[string]bool{}
+			for j := i; j < len(ids) && n < size; j++ {
+				err := idx.set(ctx, ids[j], values[j], "", written)
+				if err == errBatchFull {
+					break // needs a new transaction
+				} else if err != nil && err != ErrDuplicateIndexValue {
+					failed = true
+					return err
+				}
+				errs[j] = err
+				n++
+			}
+			return nil
+		})
+
+		// Nothing in the batch was written, so fail all of it (including the
+		// entry that caused the error)
+		if err != nil {
+			if failed {
+				n++
+			}
+			for j := i; j < i+n; j++ {
+				errs[j] = err
+			}
+		}
+		i += n
+	}
+	return multiError(errs)
+}
+
+// Read a single string property from each key.
+func getMulti(ctx appengine.Context, keys []*datastore.Key) ([]string, error) {
+	props := make([]string, len(keys))
+	dst := make([]datastore.PropertyLoadSaver, len(keys))
+	for i := range dst {
+		dst[i] = stringPLS{&props[i]}
+	}
+	return props, dsutil.GetMulti(ctx, keys, dst)
+}
+
+// Return errs if it contains any errors, or nil otherwise.
+func multiError(errs appengine.MultiError) error {
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+
+	. "github.com/chippydip/gaege/testing"
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *IndexSuite) TestIndex_GetValueMulti(c *C) {
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("TestI", "id1"),
+		"$":       "value1",
+	}, Entity{
+		"__key__": ctx.Key("TestI", "id3"),
+		"$":       "value3",
+	})
+
+	idx := NewIndex("Test", 0)
+	values, err := idx.GetValueMulti(ctx, []string{"id1", "id2", "id3"})
+	c.Check(err, DeepEquals, appengine.MultiError{nil, datastore.ErrNoSuchEntity, nil})
+	c.Check(values, DeepEquals, []string{"value1", "", "value3"})
+}
+
+func (ctx *IndexSuite) TestIndex_GetIdMulti_nonCanonical(c *C) {
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("TestV", "oldValue"),
+		"$":       "id",
+	}, Entity{
+		"__key__": ctx.Key("TestV", "value"),
+		"$":       "id",
+	}, Entity{
+		"__key__": ctx.Key("TestI", "id"),
+		"$":       "value",
+	})
+
+	idx := NewIndex("Test", 0)
+	ids, err := idx.GetIdMulti(ctx, []string{"value", "oldValue"})
+	c.Check(err, DeepEquals, appengine.MultiError{nil, datastore.ErrNoSuchEntity})
+	c.Check(ids, DeepEquals, []string{"id", ""})
+	c.Check(ctx.GetAll(c), HasLen, 2) // oldValue should have been deleted
+
+	idx = NewIndex("Test", SaveOldValues)
+	ids, err = idx.GetIdMulti(ctx, []string{"value"})
+	c.Check(err, IsNil)
+	c.Check(ids, DeepEquals, []string{"id"})
+}
+
+func (ctx *IndexSuite) TestIndex_SetMulti(c *C) {
+	for _, flags := range []Flag{0, SingleEntityGroup} {
+		ctx.Reset(c)
+		idx := NewIndex("Test", flags)
+		c.Assert(idx.Set(ctx, "taken", "value3"), IsNil)
+
+		// More entries than fit in one transaction
+		ids := make([]string, 20)
+		values := make([]string, 20)
+		for i := range ids {
+			ids[i] = fmt.Sprint("id", i)
+			values[i] = fmt.Sprint("value", i)
+		}
+		values[12] = "value11" // duplicate in the same batch
+
+		err := idx.SetMulti(ctx, ids, values)
+		errs, ok := err.(appengine.MultiError)
+		c.Assert(ok, Equals, true)
+		for i, err := range errs {
+			if i == 3 || i == 12 {
+				c.Check(err, Equals, ErrDuplicateIndexValue)
+			} else {
+				c.Check(err, IsNil)
+			}
+		}
+
+		got, err := idx.GetValueMulti(ctx, ids)
+		c.Check(err, DeepEquals, appengine.MultiError{
+			nil, nil, nil, datastore.ErrNoSuchEntity, nil, nil, nil, nil, nil, nil,
+			nil, nil, datastore.ErrNoSuchEntity, nil, nil, nil, nil, nil, nil, nil,
+		})
+		c.Check(got[11], Equals, "value11")
+	}
+}
+
+func (ctx *IndexSuite) TestIndex_SetMulti_lengthMismatch(c *C) {
+	idx := NewIndex("Test", 0)
+	err := idx.SetMulti(ctx, []string{"id"}, nil)
+	c.Check(err, Equals, ErrLengthMismatch)
+}
@@ -0,0 +1,204 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// MultiValueIndex is an index where each id has a set of values (such as all
+// the verified email addresses of a user). Each value can still only belong
+// to a single id, and the flags have the same meaning as for Index, with
+// "old values" being the values that were removed from an id.
+type MultiValueIndex struct {
+	idx Index
+}
+
+// NewMultiValueIndex creates a multi-valued index (see NewIndex). An index
+// name should only be used for one kind of index.
+func NewMultiValueIndex(name string, flags Flag, norm ...Normalizer) MultiValueIndex {
+	return MultiValueIndex{NewIndex(name, flags, norm...)}
+}
+
+// List returns the values of id in the order they were added.
+func (m MultiValueIndex) List(ctx appengine.Context, id string) ([]string, error) {
+	values, err := getList(ctx, m.idx.newKey(ctx, setEntity, id))
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return values, err
+}
+
+// GetId returns the id that has the given value.
+func (m MultiValueIndex) GetId(ctx appengine.Context, value string) (string, error) {
+	key := m.idx.valueKey(ctx, value)
+	id, err := m.idx.getId(ctx, key, value)
+
+	// If old values were supposed to be deleted, make sure this isn't an old value
+	if err == nil && m.idx.flags&SaveOldValues == 0 {
+		values, err := getList(ctx, m.idx.newKey(ctx, setEntity, id))
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return "", err
+		}
+		if m.find(values, value) < 0 {
+			// This should have been deleted, so try again and return not found
+			del(ctx, key)
+			return "", datastore.ErrNoSuchEntity
+		}
+	}
+
+	return id, err
+}
+
+// Add adds a value to the set of id, or returns ErrDuplicateIndexValue if it
+// belongs to another id. Adding a value that id already has updates its
+// original form (see NewIndex).
+func (m MultiValueIndex) Add(ctx appengine.Context, id, value string) error {
+	setKey := m.idx.newKey(ctx, setEntity, id)
+	valueKey := m.idx.valueKey(ctx, value)
+	if len(valueKey.StringID()) > kMaxKeyName {
+		return ErrValueTooLong
+	}
+
+	return dsutil.JoinTransaction(ctx, func(ctx appengine.Context) error {
+		values, err := getList(ctx, setKey)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		// Check for an existing key for this value (see Index.set)
+		currId, err := m.idx.getId(ctx, valueKey, value)
+		if err == ErrReserved {
+			return ErrDuplicateIndexValue
+		} else if err != datastore.ErrNoSuchEntity {
+			if err != nil {
+				return err
+			}
+			if currId != id {
+				if err := m.reusable(ctx, currId, value); err != nil {
+					return err
+				}
+			}
+		}
+
+		if i := m.find(values, value); i >= 0 {
+			if values[i] == value && currId == id {
+				return nil // already added
+			}
+			values[i] = value
+		} else {
+			values = append(values, value)
+		}
+
+		if err := m.idx.putId(ctx, valueKey, value, id); err != nil {
+			return err
+		}
+		return putList(ctx, setKey, values)
+	})
+}
+
+// Remove removes a value from the set of id. The value is then available to
+// other ids unless PreventReuse is set. Removing a value that id doesn't have
+// is not an error.
+func (m MultiValueIndex) Remove(ctx appengine.Context, id, value string) error {
+	setKey := m.idx.newKey(ctx, setEntity, id)
+	valueKey := m.idx.valueKey(ctx, value)
+
+	return dsutil.JoinTransaction(ctx, func(ctx appengine.Context) error {
+		values, err := getList(ctx, setKey)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		i := m.find(values, value)
+		if i < 0 {
+			return nil
+		}
+		values = append(values[:i], values[i+1:]...)
+
+		// Delete the value (unless it should be saved)
+		if m.idx.flags&SaveOldValues == 0 {
+			if currId, err := m.idx.getId(ctx, valueKey, value); err == nil && currId == id {
+				if err := datastore.Delete(ctx, valueKey); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(values) == 0 {
+			return datastore.Delete(ctx, setKey)
+		}
+		return putList(ctx, setKey, values)
+	})
+}
+
+// Check if a value that currently maps to another id can be reused.
+func (m MultiValueIndex) reusable(ctx appengine.Context, currId, value string) error {
+	if m.idx.flags&PreventReuse != 0 {
+		return ErrDuplicateIndexValue
+	}
+
+	// Check if value is still one of currId's values
+	values, err := getList(ctx, m.idx.newKey(ctx, setEntity, currId))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if m.find(values, value) >= 0 {
+		return ErrDuplicateIndexValue
+	}
+	return nil
+}
+
+// Return the index of value in values (after normalization), or -1.
+func (m MultiValueIndex) find(values []string, value string) int {
+	norm := m.idx.normalize(value)
+	for i, v := range values {
+		if m.idx.normalize(v) == norm {
+			return i
+		}
+	}
+	return -1
+}
+
+func getList(ctx appengine.Context, key *datastore.Key) (props []string, err error) {
+	err = datastore.Get(ctx, key, listPLS{&props})
+	return props, err
+}
+
+func putList(ctx appengine.Context, key *datastore.Key, props []string) (err error) {
+	_, err = datastore.Put(ctx, key, listPLS{&props})
+	return err
+}
+
+// listPLS implements datastore.PropertyLoadSaver for a list of strings
+type listPLS struct{ slice *[]string }
+
+func (pls listPLS) Load(c <-chan datastore.Property) error {
+	for p := range c {
+		if p.Name == propName && pls.slice != nil {
+			if s, ok := p.Value.(string); ok {
+				*pls.slice = append(*pls.slice, s)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (pls listPLS) Save(c chan<- datastore.Property) error {
+	defer close(c)
+
+	for _, s := range *pls.slice {
+		c <- datastore.Property{
+			Name:     propName,
+			Value:    s,
+			NoIndex:  true,
+			Multiple: true,
+		}
+	}
+
+	return nil
+}
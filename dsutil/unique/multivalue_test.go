@@ -0,0 +1,66 @@
+package unique
+
+import (
+	"appengine/datastore"
+
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *IndexSuite) TestMultiValueIndex_simple(c *C) {
+	m := NewMultiValueIndex("Test", 0, Lower)
+	c.Assert(m.Add(ctx, "id1", "a@example.com"), IsNil)
+	c.Assert(m.Add(ctx, "id1", "B@example.com"), IsNil)
+	c.Assert(m.Add(ctx, "id1", "a@example.com"), IsNil) // already added
+	c.Check(ctx.GetAll(c), HasLen, 3)
+
+	values, err := m.List(ctx, "id1")
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, []string{"a@example.com", "B@example.com"})
+
+	id, err := m.GetId(ctx, "b@example.com")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+
+	c.Check(m.Add(ctx, "id2", "A@example.com"), Equals, ErrDuplicateIndexValue)
+
+	// Removed values are released
+	c.Assert(m.Remove(ctx, "id1", "a@example.com"), IsNil)
+	_, err = m.GetId(ctx, "a@example.com")
+	c.Check(err, Equals, datastore.ErrNoSuchEntity)
+	c.Check(m.Add(ctx, "id2", "a@example.com"), IsNil)
+
+	c.Assert(m.Remove(ctx, "id1", "b@example.com"), IsNil)
+	values, err = m.List(ctx, "id1")
+	c.Check(err, IsNil)
+	c.Check(values, HasLen, 0)
+	c.Check(ctx.GetAll(c), HasLen, 2)
+}
+
+func (ctx *IndexSuite) TestMultiValueIndex_preventReuse(c *C) {
+	m := NewMultiValueIndex("Test", PreventReuse)
+	c.Assert(m.Add(ctx, "id1", "a"), IsNil)
+	c.Assert(m.Remove(ctx, "id1", "a"), IsNil)
+
+	id, err := m.GetId(ctx, "a")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+	c.Check(m.Add(ctx, "id2", "a"), Equals, ErrDuplicateIndexValue)
+
+	// The id that had it can add it again
+	c.Check(m.Add(ctx, "id1", "a"), IsNil)
+}
+
+func (ctx *IndexSuite) TestMultiValueIndex_saveOldValues(c *C) {
+	m := NewMultiValueIndex("Test", SaveOldValues)
+	c.Assert(m.Add(ctx, "id1", "a"), IsNil)
+	c.Assert(m.Remove(ctx, "id1", "a"), IsNil)
+
+	id, err := m.GetId(ctx, "a")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+
+	c.Check(m.Add(ctx, "id2", "a"), IsNil)
+	id, err = m.GetId(ctx, "a")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id2")
+}
@@ -0,0 +1,44 @@
+package unique
+
+import (
+	"strings"
+
+	"code.google.com/p/go.text/unicode/norm"
+)
+
+// Normalizer maps a value to the form used to check it for uniqueness, so
+// values that only differ in ways that don't matter (such as case) are treated
+// as the same value.
+//
+// Values are stored under their normalized form, so adding (or changing) the
+// normalizers of an index that already has values doesn't migrate them: the
+// existing values aren't found by GetId or checked for duplicates until the
+// index is fixed with Repair (or EnqueueVerify), which stores each id's value
+// under its new form and reports ids whose values now collide (as
+// DuplicateValue inconsistencies, which have to be fixed by hand).
+//
+// NFKC uses the code.google.com/p/go.text/unicode/norm package, which is not
+// part of the App Engine SDK and must be installed (or vendored) along with
+// this package.
+type Normalizer func(value string) string
+
+var (
+	// Lower maps values to lower case.
+	Lower Normalizer = strings.ToLower
+
+	// NFKC maps values to Unicode Normalization Form KC, so values that only
+	// differ in their encoding (or use compatibility characters such as
+	// full-width letters) are the same.
+	NFKC Normalizer = norm.NFKC.String
+
+	// TrimSpace removes leading and trailing white space.
+	TrimSpace Normalizer = strings.TrimSpace
+)
+
+// Apply the index's normalizers (in order) to a value.
+func (idx Index) normalize(value string) string {
+	for _, n := range idx.norm {
+		value = n(value)
+	}
+	return value
+}
@@ -0,0 +1,87 @@
+package unique
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *IndexSuite) TestIndex_normalize_lower(c *C) {
+	idx := NewIndex("Test", 0, Lower)
+	c.Assert(idx.Set(ctx, "id1", "Alice@Example.com"), IsNil)
+
+	id, err := idx.GetId(ctx, "alice@example.com")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+
+	value, err := idx.GetValue(ctx, "id1")
+	c.Check(err, IsNil)
+	c.Check(value, Equals, "Alice@Example.com")
+
+	err = idx.Set(ctx, "id2", "ALICE@example.com")
+	c.Check(err, Equals, ErrDuplicateIndexValue)
+
+	// Changing the original value keeps the same normalized value
+	c.Assert(idx.Set(ctx, "id1", "alice@example.com"), IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 2)
+
+	value, err = idx.GetValue(ctx, "id1")
+	c.Check(err, IsNil)
+	c.Check(value, Equals, "alice@example.com")
+
+	id, err = idx.GetId(ctx, "Alice@Example.com")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+}
+
+func (ctx *IndexSuite) TestIndex_normalize_chain(c *C) {
+	idx := NewIndex("Test", 0, NFKC, TrimSpace, Lower)
+	c.Assert(idx.Set(ctx, "id1", " Ｆｏｏ "), IsNil)
+
+	id, err := idx.GetId(ctx, "foo")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+
+	values, _, err := idx.ListPrefix(ctx, "FO", "", 0)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, []Mapping{{"id1", " Ｆｏｏ ", true}})
+
+	// Old values are deleted using their normalized form
+	c.Assert(idx.Set(ctx, "id1", "Bar"), IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 2)
+	c.Check(idx.Set(ctx, "id2", "FOO"), IsNil)
+}
+
+func (ctx *IndexSuite) TestIndex_normalize_added(c *C) {
+	// Values stored before the normalizer was added
+	old := NewIndex("Test", 0)
+	c.Assert(old.Set(ctx, "id1", "Alice"), IsNil)
+	c.Assert(old.Set(ctx, "id2", "alice"), IsNil)
+	c.Assert(old.Set(ctx, "id3", "Bob"), IsNil)
+	c.Assert(old.Set(ctx, "id4", "BOB"), IsNil)
+
+	idx := NewIndex("Test", 0, Lower)
+	var repaired []Inconsistency
+	for cursor := ""; ; {
+		found, next, err := idx.Repair(ctx, cursor, 0)
+		c.Assert(err, IsNil)
+		repaired = append(repaired, found...)
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+
+	// Values that now collide are reported (including when the first one
+	// only got its new form during the repair)
+	c.Check(repaired, DeepEquals, []Inconsistency{
+		{DuplicateValue, "id1", "Alice", false},
+		{MissingValue, "id3", "Bob", true},
+		{DuplicateValue, "id4", "BOB", false},
+		{StaleValue, "id1", "Alice", true},
+		{StaleValue, "id4", "BOB", true},
+		{StaleValue, "id3", "Bob", true},
+	})
+	c.Check(ctx.GetAll(c), HasLen, 6)
+
+	id, err := idx.GetId(ctx, "BOB")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id3")
+}
@@ -0,0 +1,212 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+var (
+	// ErrReserved is returned by GetId for values that are reserved but not
+	// yet confirmed.
+	ErrReserved = errors.New("unique: value is reserved")
+
+	// ErrReservationExpired is returned by Confirm if the reservation has
+	// expired or was released.
+	ErrReservationExpired = errors.New("unique: reservation expired or released")
+
+	// ErrInvalidToken is returned by Confirm and Release for strings that
+	// weren't returned by Reserve.
+	ErrInvalidToken = errors.New("unique: invalid reservation token")
+)
+
+// Reserve claims a value before the id that will own it is known. The value
+// is taken (as far as Set, GetId and other reservations are concerned) until
+// the returned token is passed to Confirm or Release, or until ttl has passed
+// and it can be claimed again (expired reservations are deleted by Sweep).
+//
+// The token is opaque (it doesn't contain the value), so it can be handed to
+// clients. The value it reserves is stored in an entity named after it.
+func (idx Index) Reserve(ctx appengine.Context, value string, ttl time.Duration) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	key := idx.valueKey(ctx, value)
+	if len(key.StringID()) > kMaxKeyName {
+		return "", ErrValueTooLong
+	}
+
+	err := dsutil.JoinTransaction(ctx, func(ctx appengine.Context) error {
+		// The same checks as Set, except that no id can already have it
+		var currId string
+		props, err := idx.loadValue(ctx, key, value)
+		if err == nil {
+			currId, err = props.getId()
+		}
+		if err == ErrReserved {
+			return ErrDuplicateIndexValue
+		} else if err != datastore.ErrNoSuchEntity {
+			if err != nil {
+				return err
+			}
+			if err := idx.reusable(ctx, currId, value, props.retired, nil); err != nil {
+				return err
+			}
+		}
+
+		props = idx.newValueProps(key, value, "")
+		props.token, props.expires = token, time.Now().Add(ttl)
+		if _, err = datastore.Put(ctx, key, props); err != nil {
+			return err
+		}
+		_, err = datastore.Put(ctx, idx.newKey(ctx, reservationEntity, token), &reservation{value, props.expires})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Confirm sets the reserved value for id (as if by Set) and ends the
+// reservation. It uses one more entity group than Set (unless the index is a
+// SingleEntityGroup).
+func (idx Index) Confirm(ctx appengine.Context, token, id string) error {
+	tokenKey, err := idx.tokenKey(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	return dsutil.JoinTransaction(ctx, func(ctx appengine.Context) error {
+		r, props, err := idx.loadReservation(ctx, tokenKey)
+		if err == datastore.ErrNoSuchEntity {
+			return ErrReservationExpired
+		} else if err != nil {
+			return err
+		}
+		if props == nil || props.token != token || !time.Now().Before(props.expires) {
+			return ErrReservationExpired
+		}
+
+		if err := idx.set(ctx, id, r.value, token, map[string]bool{}); err != nil {
+			return err
+		}
+		return datastore.Delete(ctx, tokenKey)
+	})
+}
+
+// Release ends a reservation without using the value. Releasing a reservation
+// that has expired (or was already confirmed or released) is not an error.
+func (idx Index) Release(ctx appengine.Context, token string) error {
+	tokenKey, err := idx.tokenKey(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	return dsutil.JoinTransaction(ctx, func(ctx appengine.Context) error {
+		_, err := idx.release(ctx, tokenKey, false)
+		return err
+	})
+}
+
+// Delete a reservation (and the value it holds, if it still does) in the
+// current transaction, reporting whether anything was deleted. If `expired`
+// is true, only a reservation that has expired is deleted.
+func (idx Index) release(ctx appengine.Context, tokenKey *datastore.Key, expired bool) (bool, error) {
+	r, props, err := idx.loadReservation(ctx, tokenKey)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if expired && time.Now().Before(r.expires) {
+		return false, nil
+	}
+
+	keys := []*datastore.Key{tokenKey}
+	if props != nil && props.token == tokenKey.StringID() {
+		keys = append(keys, idx.valueKey(ctx, r.value))
+	}
+	return true, datastore.DeleteMulti(ctx, keys)
+}
+
+// Create the key of the reservation entity for a token.
+func (idx Index) tokenKey(ctx appengine.Context, token string) (*datastore.Key, error) {
+	if b, err := hex.DecodeString(token); err != nil || len(b) != 16 {
+		return nil, ErrInvalidToken
+	}
+	return idx.newKey(ctx, reservationEntity, token), nil
+}
+
+// Read a reservation and the V entity of its value (nil if it is missing).
+func (idx Index) loadReservation(ctx appengine.Context, tokenKey *datastore.Key) (*reservation, *valueProps, error) {
+	r := new(reservation)
+	if err := datastore.Get(ctx, tokenKey, r); err != nil {
+		return nil, nil, err
+	}
+	props, err := idx.loadValue(ctx, idx.valueKey(ctx, r.value), r.value)
+	if err == datastore.ErrNoSuchEntity || err == ErrHashCollision {
+		return r, nil, nil
+	}
+	return r, props, err
+}
+
+// reservation implements datastore.PropertyLoadSaver for R entities, which
+// store the reserved value and when the reservation expires.
+type reservation struct {
+	value   string
+	expires time.Time
+}
+
+func (r *reservation) Load(c <-chan datastore.Property) error {
+	for p := range c {
+		switch v := p.Value.(type) {
+		case string:
+			if p.Name == propName {
+				r.value = v
+			}
+		case time.Time:
+			if p.Name == expiresPropName {
+				r.expires = v
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *reservation) Save(c chan<- datastore.Property) error {
+	defer close(c)
+
+	c <- datastore.Property{
+		Name:    propName,
+		Value:   r.value,
+		NoIndex: true,
+	}
+	c <- datastore.Property{
+		Name:  expiresPropName,
+		Value: r.expires, // indexed (see Sweep)
+	}
+
+	return nil
+}
+
+// Return the id that the value maps to, or an error if it is reserved (or was
+// reserved, but the reservation has expired).
+func (props *valueProps) getId() (string, error) {
+	if props.token == "" {
+		return props.id, nil
+	}
+	if time.Now().Before(props.expires) {
+		return "", ErrReserved
+	}
+	return "", datastore.ErrNoSuchEntity
+}
@@ -0,0 +1,96 @@
+package unique
+
+import (
+	"appengine/datastore"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *IndexSuite) TestIndex_Reserve_confirm(c *C) {
+	idx := NewIndex("Test", 0)
+	token, err := idx.Reserve(ctx, "value", time.Minute)
+	c.Assert(err, IsNil)
+
+	_, err = idx.GetId(ctx, "value")
+	c.Check(err, Equals, ErrReserved)
+	c.Check(idx.Set(ctx, "id2", "value"), Equals, ErrDuplicateIndexValue)
+	_, err = idx.Reserve(ctx, "value", time.Minute)
+	c.Check(err, Equals, ErrDuplicateIndexValue)
+
+	values, _, err := idx.ListValues(ctx, "", 0)
+	c.Check(err, IsNil)
+	c.Check(values, HasLen, 0)
+
+	c.Assert(idx.Confirm(ctx, token, "id1"), IsNil)
+	id, err := idx.GetId(ctx, "value")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+	c.Check(ctx.GetAll(c), HasLen, 2)
+
+	// The reservation is over, so these don't change anything
+	c.Check(idx.Confirm(ctx, token, "id2"), Equals, ErrReservationExpired)
+	c.Check(idx.Release(ctx, token), IsNil)
+	id, err = idx.GetId(ctx, "value")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, "id1")
+}
+
+func (ctx *IndexSuite) TestIndex_Reserve_release(c *C) {
+	idx := NewIndex("Test", 0)
+	token, err := idx.Reserve(ctx, "value", time.Minute)
+	c.Assert(err, IsNil)
+
+	c.Check(token, Not(Matches), ".*value.*")
+
+	c.Assert(idx.Release(ctx, token), IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 0)
+	_, err = idx.GetId(ctx, "value")
+	c.Check(err, Equals, datastore.ErrNoSuchEntity)
+
+	c.Check(idx.Confirm(ctx, token, "id1"), Equals, ErrReservationExpired)
+	c.Check(idx.Set(ctx, "id2", "value"), IsNil)
+}
+
+func (ctx *IndexSuite) TestIndex_Reserve_expired(c *C) {
+	idx := NewIndex("Test", 0)
+	token, err := idx.Reserve(ctx, "value", -time.Second)
+	c.Assert(err, IsNil)
+
+	_, err = idx.GetId(ctx, "value")
+	c.Check(err, Equals, datastore.ErrNoSuchEntity)
+	c.Check(idx.Confirm(ctx, token, "id1"), Equals, ErrReservationExpired)
+
+	// Expired reservations can be reclaimed
+	token2, err := idx.Reserve(ctx, "value", time.Minute)
+	c.Assert(err, IsNil)
+	c.Check(idx.Confirm(ctx, token, "id1"), Equals, ErrReservationExpired)
+	c.Check(idx.Confirm(ctx, token2, "id2"), IsNil)
+}
+
+func (ctx *IndexSuite) TestIndex_Reserve_taken(c *C) {
+	idx := NewIndex("Test", 0)
+	c.Assert(idx.Set(ctx, "id1", "value"), IsNil)
+
+	_, err := idx.Reserve(ctx, "value", time.Minute)
+	c.Check(err, Equals, ErrDuplicateIndexValue)
+	c.Check(idx.Release(ctx, "invalid"), Equals, ErrInvalidToken)
+}
+
+func (ctx *IndexSuite) TestIndex_Reserve_sweep(c *C) {
+	idx := NewIndex("Test", 0)
+	_, err := idx.Reserve(ctx, "a", -time.Second)
+	c.Assert(err, IsNil)
+	_, err = idx.Reserve(ctx, "b", time.Minute)
+	c.Assert(err, IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 4)
+
+	// Only the expired reservation (and its value) is deleted
+	n, cursor, err := idx.Sweep(ctx, "", 0)
+	c.Check(err, IsNil)
+	c.Check(n, Equals, 1)
+	c.Check(cursor, Equals, "")
+	c.Check(ctx.GetAll(c), HasLen, 2)
+	_, err = idx.GetId(ctx, "b")
+	c.Check(err, Equals, ErrReserved)
+}
@@ -0,0 +1,147 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"reflect"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// DuplicateError is returned by Put when a field's value is already used by
+// another entity.
+type DuplicateError struct {
+	Field string // name of the struct field
+	Index string // name of the index
+	Value string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("unique: duplicate value %q for field %s (index %q)", e.Value, e.Field, e.Index)
+}
+
+// A string field of a struct with a `unique:"IndexName"` tag.
+type uniqueField struct {
+	field string
+	idx   KeyIndex
+	value string
+}
+
+// Put saves src (a pointer to a struct) like datastore.Put, while keeping the
+// value of each string field tagged with `unique:"IndexName"` unique using the
+// KeyIndex with that name, which must be registered (see Register):
+//
+//	var emails = unique.NewKeyIndex("UserEmail", 0)
+//
+//	func init() {
+//		unique.Register(emails.Index())
+//	}
+//
+//	type User struct {
+//		Email string `unique:"UserEmail"`
+//	}
+//
+// Everything is done in a single cross-group transaction (or in the enclosing
+// one, see dsutil.JoinTransaction), which fails with a *DuplicateError if any
+// value is in use. The entity's key is used as the id, and an empty value
+// removes the entity from the index.
+//
+// Each field uses up to 4 entity groups (1 if its index is a
+// SingleEntityGroup) in addition to the entity's, and an error is returned
+// without saving anything if that adds up to more than
+// dsutil.MaxEntityGroups.
+func Put(ctx appengine.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	fields, err := uniqueFields(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *datastore.Key
+	err = dsutil.JoinTransaction(ctx, func(ctx appengine.Context) error {
+		// Save the entity first to complete the key if needed
+		k, err := datastore.Put(ctx, key, src)
+		if err != nil {
+			return err
+		}
+		result = k
+
+		for _, f := range fields {
+			if f.value == "" {
+				err = f.idx.DeleteId(ctx, k)
+			} else {
+				err = f.idx.Set(ctx, k, f.value)
+			}
+			if err == ErrDuplicateIndexValue {
+				return &DuplicateError{f.field, f.idx.idx.name, f.value}
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Delete deletes the entity with the given key like datastore.Delete and
+// releases its values from the indexes used by the unique fields of src (see
+// Put), which is only used for its type.
+func Delete(ctx appengine.Context, key *datastore.Key, src interface{}) error {
+	fields, err := uniqueFields(src)
+	if err != nil {
+		return err
+	}
+
+	return dsutil.JoinTransaction(ctx, func(ctx appengine.Context) error {
+		for _, f := range fields {
+			if err := f.idx.DeleteId(ctx, key); err != nil {
+				return err
+			}
+		}
+		return datastore.Delete(ctx, key)
+	})
+}
+
+// Find the tagged fields of a pointer to a struct.
+func uniqueFields(src interface{}) ([]uniqueField, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("unique: expected a pointer to a struct, got %T", src)
+	}
+	v = v.Elem()
+
+	var fields []uniqueField
+	groups := 1 // the entity itself
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("unique")
+		if name == "" {
+			continue
+		}
+		if f.Type.Kind() != reflect.String {
+			return nil, fmt.Errorf("unique: field %s of %v has a unique tag but isn't a string", f.Name, t)
+		}
+
+		idx, ok := indexes[name]
+		if !ok {
+			return nil, fmt.Errorf("unique: index %q used by field %s of %v is not registered", name, f.Name, t)
+		} else if idx.ids != keyIds {
+			return nil, fmt.Errorf("unique: index %q used by field %s of %v isn't a KeyIndex", name, f.Name, t)
+		}
+		fields = append(fields, uniqueField{f.Name, KeyIndex{idx}, v.Field(i).String()})
+
+		if idx.flags&SingleEntityGroup == 0 {
+			groups += 4
+		} else {
+			groups++
+		}
+	}
+	if groups > dsutil.MaxEntityGroups {
+		return nil, fmt.Errorf("unique: the unique fields of %v need up to %d entity groups (more than dsutil.MaxEntityGroups)", t, groups)
+	}
+	return fields, nil
+}
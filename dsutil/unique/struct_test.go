@@ -0,0 +1,82 @@
+package unique
+
+import (
+	"appengine/datastore"
+
+	. "launchpad.net/gocheck"
+)
+
+var testEmails = NewKeyIndex("TestEmail", 0)
+
+func init() {
+	Register(testEmails.Index())
+	Register(NewIndex("TestName", 0))
+}
+
+type testUser struct {
+	Name  string
+	Email string `unique:"TestEmail"`
+}
+
+func (ctx *IndexSuite) TestPut(c *C) {
+	key1, err := Put(ctx, datastore.NewIncompleteKey(ctx, "User", nil), &testUser{"one", "a"})
+	c.Assert(err, IsNil)
+	c.Check(key1.Incomplete(), Equals, false)
+	c.Check(ctx.GetAll(c), HasLen, 3)
+
+	id, err := testEmails.GetId(ctx, "a")
+	c.Check(err, IsNil)
+	c.Check(id.Equal(key1), Equals, true)
+
+	// Duplicates roll back the whole transaction
+	key2 := datastore.NewKey(ctx, "User", "two", 0, nil)
+	_, err = Put(ctx, key2, &testUser{"two", "a"})
+	c.Check(err, DeepEquals, &DuplicateError{"Email", "TestEmail", "a"})
+	c.Check(datastore.Get(ctx, key2, &testUser{}), Equals, datastore.ErrNoSuchEntity)
+
+	// Changing the value releases the old one
+	_, err = Put(ctx, key1, &testUser{"one", "b"})
+	c.Assert(err, IsNil)
+	_, err = Put(ctx, key2, &testUser{"two", "a"})
+	c.Assert(err, IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 6)
+
+	// And so does deleting the entity
+	c.Assert(Delete(ctx, key1, &testUser{}), IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 3)
+	_, err = Put(ctx, key2, &testUser{"two", "b"})
+	c.Check(err, IsNil)
+}
+
+func (ctx *IndexSuite) TestPut_invalid(c *C) {
+	key := datastore.NewKey(ctx, "User", "one", 0, nil)
+	_, err := Put(ctx, key, testUser{"one", "a"})
+	c.Check(err, ErrorMatches, "unique: expected a pointer to a struct.*")
+
+	type badUser struct {
+		Age int `unique:"TestEmail"`
+	}
+	_, err = Put(ctx, key, &badUser{42})
+	c.Check(err, ErrorMatches, ".* isn't a string")
+
+	type unregisteredUser struct {
+		Email string `unique:"TestUnknown"`
+	}
+	_, err = Put(ctx, key, &unregisteredUser{"a"})
+	c.Check(err, ErrorMatches, `unique: index "TestUnknown" .* is not registered`)
+
+	type stringIdUser struct {
+		Name string `unique:"TestName"`
+	}
+	_, err = Put(ctx, key, &stringIdUser{"a"})
+	c.Check(err, ErrorMatches, `unique: index "TestName" .* isn't a KeyIndex`)
+
+	type bigUser struct {
+		Email string `unique:"TestEmail"`
+		Other string `unique:"TestEmail"`
+	}
+	_, err = Put(ctx, key, &bigUser{"a", "b"})
+	c.Check(err, ErrorMatches, "unique: the unique fields of .* need up to 9 entity groups .*")
+
+	c.Check(ctx.GetAll(c), HasLen, 0)
+}
@@ -0,0 +1,123 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/taskqueue"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// VerifyPath is the URL path that VerifyHandler should be mapped to:
+//
+//	http.Handle(unique.VerifyPath, unique.VerifyHandler)
+const VerifyPath = "/_ah/unique/verify"
+
+// VerifyHandler runs the tasks queued by EnqueueVerify.
+var VerifyHandler http.Handler = http.HandlerFunc(handleVerify)
+
+// Number of entities checked by each verify task.
+const kVerifyBatch = 100
+
+// Indexes that can be used by verify tasks (see Register).
+var indexes = map[string]Index{}
+
+// Register makes an index available to EnqueueVerify, SweepHandler and Put
+// (which need to know its flags and normalizers). It should be called during
+// program initialization and panics if an index with the same name is already
+// registered.
+func Register(idx Index) Index {
+	if _, ok := indexes[idx.name]; ok {
+		panic("unique: index " + strconv.Quote(idx.name) + " already registered")
+	}
+	indexes[idx.name] = idx
+	return idx
+}
+
+// EnqueueVerify starts checking the index in the background using a chain of
+// tasks on the given queue ("" for the default queue). Each task checks a
+// batch of entities (see Verify) and logs any inconsistencies it finds. If
+// `repair` is true, they are also fixed (see Repair).
+//
+// The index must be registered (see Register). Tasks are named after the step
+// they perform, so a retried task doesn't start a second chain.
+func (idx Index) EnqueueVerify(ctx appengine.Context, queue string, repair bool) error {
+	if _, ok := indexes[idx.name]; !ok {
+		return fmt.Errorf("unique: index %q is not registered", idx.name)
+	}
+
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+	return enqueueVerifyStep(ctx, idx.name, queue, run, repair, 0, "")
+}
+
+// Queue the task that continues verifying from `cursor`.
+func enqueueVerifyStep(ctx appengine.Context, name, queue, run string, repair bool, step int, cursor string) error {
+	t := taskqueue.NewPOSTTask(VerifyPath, url.Values{
+		"name":   {name},
+		"queue":  {queue},
+		"run":    {run},
+		"repair": {strconv.FormatBool(repair)},
+		"step":   {strconv.Itoa(step)},
+		"cursor": {cursor},
+	})
+
+	t.Name = dsutil.TaskName("unique-verify", name, run, step)
+	return dsutil.AddTask(ctx, t, queue)
+}
+
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	serveVerify(appengine.NewContext(r), w, r)
+}
+
+func serveVerify(ctx appengine.Context, w http.ResponseWriter, r *http.Request) {
+	if !dsutil.IsTaskRequest(r) {
+		http.Error(w, "unique: verify must be run from a task queue", http.StatusForbidden)
+		return
+	}
+
+	name, queue, run, cursor := r.FormValue("name"), r.FormValue("queue"), r.FormValue("run"), r.FormValue("cursor")
+	repair, err1 := strconv.ParseBool(r.FormValue("repair"))
+	step, err2 := strconv.Atoi(r.FormValue("step"))
+	if name == "" || run == "" || err1 != nil || err2 != nil {
+		// Retrying won't help, so log and drop the task
+		ctx.Errorf("unique: invalid verify task: %v", r.Form)
+		return
+	}
+	idx, ok := indexes[name]
+	if !ok {
+		ctx.Errorf("unique: verify %q: index is not registered", name)
+		return
+	}
+
+	// Check (and fix) one batch
+	check := idx.Verify
+	if repair {
+		check = idx.Repair
+	}
+	found, next, err := check(ctx, cursor, kVerifyBatch)
+	for _, inc := range found {
+		if inc.Fixed {
+			ctx.Infof("unique: verify %q: repaired %v", name, inc)
+		} else {
+			ctx.Warningf("unique: verify %q: %v", name, inc)
+		}
+	}
+	if err != nil {
+		ctx.Errorf("unique: verify %q: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if next == "" {
+		ctx.Infof("unique: verify %q: done", name)
+		return
+	}
+	if err := enqueueVerifyStep(ctx, name, queue, run, repair, step+1, next); err != nil {
+		ctx.Errorf("unique: verify %q: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,21 @@
+package unique
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *IndexSuite) TestIndex_handleVerify_notFromQueue(c *C) {
+	form := url.Values{"name": {"Test"}, "run": {"run"}, "repair": {"true"}, "step": {"0"}}
+	r, err := http.NewRequest("POST", VerifyPath, strings.NewReader(form.Encode()))
+	c.Assert(err, IsNil)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	serveVerify(ctx, w, r)
+	c.Check(w.Code, Equals, http.StatusForbidden)
+}
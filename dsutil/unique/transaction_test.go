@@ -0,0 +1,61 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+
+	"github.com/chippydip/gaege/dsutil"
+	. "launchpad.net/gocheck"
+)
+
+type user struct {
+	Email string
+}
+
+func (ctx *IndexSuite) TestIndex_Set_joinTransaction(c *C) {
+	idx := NewIndex("Test", 0)
+	key := datastore.NewKey(ctx, "User", "id1", 0, nil)
+
+	err := dsutil.RunInTransaction(ctx, func(tc appengine.Context) error {
+		if _, err := datastore.Put(tc, key, &user{"value"}); err != nil {
+			return err
+		}
+		return idx.Set(tc, "id1", "value")
+	})
+	c.Assert(err, IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 3)
+
+	// A failed Set rolls back the whole transaction
+	key2 := datastore.NewKey(ctx, "User", "id2", 0, nil)
+	err = dsutil.RunInTransaction(ctx, func(tc appengine.Context) error {
+		if _, err := datastore.Put(tc, key2, &user{"value"}); err != nil {
+			return err
+		}
+		return idx.Set(tc, "id2", "value")
+	})
+	c.Check(err, Equals, ErrDuplicateIndexValue)
+	c.Check(datastore.Get(ctx, key2, &user{}), Equals, datastore.ErrNoSuchEntity)
+	_, err = idx.GetValue(ctx, "id2")
+	c.Check(err, Equals, datastore.ErrNoSuchEntity)
+}
+
+func (ctx *IndexSuite) TestIndex_SetMulti_joinTransaction(c *C) {
+	idx := NewIndex("Test", SingleEntityGroup)
+	rollback := errors.New("rollback")
+
+	err := dsutil.RunInTransaction(ctx, func(tc appengine.Context) error {
+		err := idx.SetMulti(tc, []string{"id1", "id2", "id3"}, []string{"a", "b", "a"})
+		c.Check(err, DeepEquals, appengine.MultiError{nil, nil, ErrConflict})
+		return rollback
+	})
+	c.Check(err, Equals, rollback)
+	for _, id := range []string{"id1", "id2", "id3"} {
+		_, err = idx.GetValue(ctx, id)
+		c.Check(err, Equals, datastore.ErrNoSuchEntity)
+	}
+	for _, value := range []string{"a", "b"} {
+		_, err = idx.GetId(ctx, value)
+		c.Check(err, Equals, datastore.ErrNoSuchEntity)
+	}
+}
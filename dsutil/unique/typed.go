@@ -0,0 +1,163 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"strconv"
+)
+
+// How ids are stored in the V entities of an index. Ids are always strings in
+// the key names of the I entities (and in Index methods), using the decimal
+// form of integers and the encoded form of keys (see datastore.Key.Encode).
+type idType int
+
+const (
+	stringIds idType = iota
+	intIds
+	keyIds
+)
+
+// ErrInvalidId is returned when an id of an IntIndex or KeyIndex (passed to
+// the underlying Index as a string) isn't an integer or an encoded key.
+var ErrInvalidId = errors.New("unique: invalid id")
+
+// Convert a string id to the value stored in a V entity.
+func (t idType) value(id string) (interface{}, error) {
+	if id == "" {
+		return id, nil // not mapped to an id (see Reserve)
+	}
+	switch t {
+	case intIds:
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidId
+		}
+		return n, nil
+	case keyIds:
+		key, err := datastore.DecodeKey(id)
+		if err != nil {
+			return nil, ErrInvalidId
+		}
+		return key, nil
+	}
+	return id, nil
+}
+
+// Convert a value stored in an entity to a string id.
+func idString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case *datastore.Key:
+		return v.Encode(), true
+	}
+	return "", false
+}
+
+// KeyIndex is an Index whose ids are datastore keys (such as the key of the
+// entity that has the value). The keys are stored as key properties, so they
+// show up as references in the datastore viewer.
+type KeyIndex struct {
+	idx Index
+}
+
+// NewKeyIndex creates an index with key ids (see NewIndex).
+func NewKeyIndex(name string, flags Flag, norm ...Normalizer) KeyIndex {
+	idx := NewIndex(name, flags, norm...)
+	idx.ids = keyIds
+	return KeyIndex{idx}
+}
+
+// Index returns the underlying Index (whose ids are encoded keys).
+func (ki KeyIndex) Index() Index {
+	return ki.idx
+}
+
+// Encode a key id, which must be complete.
+func keyId(id *datastore.Key) (string, error) {
+	if id == nil || id.Incomplete() {
+		return "", datastore.ErrInvalidKey
+	}
+	return id.Encode(), nil
+}
+
+// GetValue returns the current value of id (see Index.GetValue).
+func (ki KeyIndex) GetValue(ctx appengine.Context, id *datastore.Key) (string, error) {
+	s, err := keyId(id)
+	if err != nil {
+		return "", err
+	}
+	return ki.idx.GetValue(ctx, s)
+}
+
+// GetId returns the id that has the given value (see Index.GetId).
+func (ki KeyIndex) GetId(ctx appengine.Context, value string) (*datastore.Key, error) {
+	id, err := ki.idx.GetId(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.DecodeKey(id)
+}
+
+// Set maps value to id (see Index.Set).
+func (ki KeyIndex) Set(ctx appengine.Context, id *datastore.Key, value string) error {
+	s, err := keyId(id)
+	if err != nil {
+		return err
+	}
+	return ki.idx.Set(ctx, s, value)
+}
+
+// DeleteId removes id and its current value (see Index.DeleteId).
+func (ki KeyIndex) DeleteId(ctx appengine.Context, id *datastore.Key) error {
+	s, err := keyId(id)
+	if err != nil {
+		return err
+	}
+	return ki.idx.DeleteId(ctx, s)
+}
+
+// IntIndex is an Index whose ids are integers, which are stored as integer
+// properties.
+type IntIndex struct {
+	idx Index
+}
+
+// NewIntIndex creates an index with integer ids (see NewIndex).
+func NewIntIndex(name string, flags Flag, norm ...Normalizer) IntIndex {
+	idx := NewIndex(name, flags, norm...)
+	idx.ids = intIds
+	return IntIndex{idx}
+}
+
+// Index returns the underlying Index (whose ids are decimal integers).
+func (ii IntIndex) Index() Index {
+	return ii.idx
+}
+
+// GetValue returns the current value of id (see Index.GetValue).
+func (ii IntIndex) GetValue(ctx appengine.Context, id int64) (string, error) {
+	return ii.idx.GetValue(ctx, strconv.FormatInt(id, 10))
+}
+
+// GetId returns the id that has the given value (see Index.GetId).
+func (ii IntIndex) GetId(ctx appengine.Context, value string) (int64, error) {
+	id, err := ii.idx.GetId(ctx, value)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(id, 10, 64)
+}
+
+// Set maps value to id (see Index.Set).
+func (ii IntIndex) Set(ctx appengine.Context, id int64, value string) error {
+	return ii.idx.Set(ctx, strconv.FormatInt(id, 10), value)
+}
+
+// DeleteId removes id and its current value (see Index.DeleteId).
+func (ii IntIndex) DeleteId(ctx appengine.Context, id int64) error {
+	return ii.idx.DeleteId(ctx, strconv.FormatInt(id, 10))
+}
@@ -0,0 +1,69 @@
+package unique
+
+import (
+	"appengine/datastore"
+
+	. "github.com/chippydip/gaege/testing"
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *IndexSuite) TestKeyIndex(c *C) {
+	ki := NewKeyIndex("Test", 0)
+	user := datastore.NewKey(ctx, "User", "", 42, nil)
+	c.Assert(ki.Set(ctx, user, "value"), IsNil)
+
+	id, err := ki.GetId(ctx, "value")
+	c.Check(err, IsNil)
+	c.Check(id, KeyEquals, "User", "", 42, false)
+
+	value, err := ki.GetValue(ctx, user)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, "value")
+
+	// The id is stored as a key
+	all := ctx.GetAll(c)
+	stored := all[ctx.Key("TestV", "value").Encode()]["$"]
+	c.Assert(stored, FitsTypeOf, user)
+	c.Check(stored.(*datastore.Key).Equal(user), Equals, true)
+
+	c.Assert(ki.DeleteId(ctx, user), IsNil)
+	c.Check(ctx.GetAll(c), HasLen, 0)
+}
+
+func (ctx *IndexSuite) TestIntIndex(c *C) {
+	ii := NewIntIndex("Test", 0)
+	c.Assert(ii.Set(ctx, 42, "value"), IsNil)
+	c.Check(ii.Set(ctx, 43, "value"), Equals, ErrDuplicateIndexValue)
+
+	id, err := ii.GetId(ctx, "value")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, int64(42))
+
+	stored := ctx.GetAll(c)[ctx.Key("TestV", "value").Encode()]["$"]
+	c.Check(stored, Equals, int64(42))
+
+	// Existing string ids can still be read
+	ctx.PutAll(c, Entity{
+		"__key__": ctx.Key("TestV", "other"),
+		"$":       "7",
+	}, Entity{
+		"__key__": ctx.Key("TestI", "7"),
+		"$":       "other",
+	})
+	id, err = ii.GetId(ctx, "other")
+	c.Check(err, IsNil)
+	c.Check(id, Equals, int64(7))
+}
+
+func (ctx *IndexSuite) TestTypedIndex_invalidIds(c *C) {
+	ki := NewKeyIndex("Test", 0)
+	c.Check(ki.Set(ctx, nil, "value"), Equals, datastore.ErrInvalidKey)
+	c.Check(ki.DeleteId(ctx, nil), Equals, datastore.ErrInvalidKey)
+	_, err := ki.GetValue(ctx, nil)
+	c.Check(err, Equals, datastore.ErrInvalidKey)
+	c.Check(ki.Index().Set(ctx, "not a key", "value"), Equals, ErrInvalidId)
+
+	ii := NewIntIndex("Test", 0)
+	c.Check(ii.Index().Set(ctx, "x", "value"), Equals, ErrInvalidId)
+	c.Check(ctx.GetAll(c), HasLen, 0)
+}
@@ -0,0 +1,296 @@
+package unique
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"strings"
+
+	"github.com/chippydip/gaege/dsutil"
+)
+
+// Problem is a kind of inconsistency found by Verify.
+type Problem int
+
+const (
+	// An id's current value isn't mapped to anything (its V entity is
+	// missing). Repair restores the mapping.
+	MissingValue Problem = iota
+
+	// An id's current value is mapped to a different id (or reserved). Repair
+	// gives the value to this id unless it is the other id's current value
+	// too, in which case it is only reported (without Fixed set) since this
+	// id needs a new value (see Set) and there is no other value to give it.
+	DuplicateValue
+
+	// A value is mapped to an id that has a different current value (or no
+	// value) even though SaveOldValues isn't set. Repair deletes the mapping.
+	StaleValue
+)
+
+var problemNames = [...]string{"missing value", "duplicate value", "stale value"}
+
+func (p Problem) String() string {
+	if p < 0 || int(p) >= len(problemNames) {
+		return fmt.Sprintf("Problem(%d)", int(p))
+	}
+	return problemNames[p]
+}
+
+// Inconsistency is a single problem found by Verify.
+type Inconsistency struct {
+	Problem Problem
+	Id      string
+	Value   string // as normalized when it was stored for StaleValue
+
+	// Fixed is set by Repair for the inconsistencies it fixed. The others
+	// have to be fixed by hand (see DuplicateValue).
+	Fixed bool
+}
+
+func (inc Inconsistency) String() string {
+	return fmt.Sprintf("%v: %q -> %q", inc.Problem, inc.Id, inc.Value)
+}
+
+// Verify checks (up to) `limit` entities of the index for inconsistencies,
+// starting at the given cursor ("" for the first page), and returns them
+// along with a cursor for the next call ("" once the whole index has been
+// checked). Ids are checked first and then values, so a full check reads
+// every entity of the index once (values are only checked if SaveOldValues
+// isn't set, since otherwise any value may be an old one).
+func (idx Index) Verify(ctx appengine.Context, cursor string, limit int) ([]Inconsistency, string, error) {
+	// The cursor says which kind of entity to continue with
+	kind := idEntity
+	if i := strings.Index(cursor, ":"); i > 0 {
+		kind, cursor = cursor[:i], cursor[i+1:]
+	} else if cursor != "" {
+		return nil, "", fmt.Errorf("unique: invalid verify cursor %q", cursor)
+	}
+
+	var found []Inconsistency
+	var next string
+	var err error
+	switch kind {
+	case idEntity:
+		found, next, err = idx.verifyIds(ctx, cursor, limit)
+		if next != "" {
+			next = idEntity + ":" + next
+		} else if idx.flags&SaveOldValues == 0 {
+			next = valueEntity + ":" // now check the values
+		}
+	case valueEntity:
+		found, next, err = idx.verifyValues(ctx, cursor, limit)
+		if next != "" {
+			next = valueEntity + ":" + next
+		}
+	default:
+		return nil, "", fmt.Errorf("unique: invalid verify cursor %q", kind+":"+cursor)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return found, next, nil
+}
+
+// Repair is like Verify but also fixes the inconsistencies it finds, using
+// batched transactions that check each one is still present. It returns the
+// inconsistencies that were still present, with Fixed set for those it fixed.
+func (idx Index) Repair(ctx appengine.Context, cursor string, limit int) ([]Inconsistency, string, error) {
+	found, next, err := idx.Verify(ctx, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Each fix uses up to 3 entity groups (the id, the value and the id the
+	// value is mapped to)
+	size := kMaxSetBatch
+	if idx.flags&SingleEntityGroup == 0 {
+		size = dsutil.MaxEntityGroups / 3
+	}
+
+	var repaired []Inconsistency
+	for len(found) > 0 {
+		var done []Inconsistency
+		n := 0
+		err := dsutil.RunInTransaction(ctx, func(ctx appengine.Context) error {
+			done, n = nil, 0
+			written := map[string]bool{}
+			for _, inc := range found {
+				if n == size {
+					break
+				}
+				ok, err := idx.fix(ctx, &inc, written)
+				if err == errBatchFull {
+					break // needs a new transaction
+				} else if err != nil {
+					return err
+				}
+				if ok {
+					done = append(done, inc)
+				}
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			return repaired, "", err
+		}
+		repaired = append(repaired, done...)
+		found = found[n:]
+	}
+	return repaired, next, nil
+}
+
+// Check the index entities of (up to) `limit` ids.
+func (idx Index) verifyIds(ctx appengine.Context, cursor string, limit int) ([]Inconsistency, string, error) {
+	keys, values, _, next, err := idx.list(ctx, idEntity, "", cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Read the V entity of each value
+	valueKeys := make([]*datastore.Key, len(keys))
+	props := make([]valueProps, len(keys))
+	dst := make([]datastore.PropertyLoadSaver, len(keys))
+	for i, value := range values {
+		valueKeys[i] = idx.valueKey(ctx, value)
+		dst[i] = &props[i]
+	}
+	err = dsutil.GetMulti(ctx, valueKeys, dst)
+	errs, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, "", err
+	}
+
+	var found []Inconsistency
+	for i, key := range keys {
+		inc := Inconsistency{Id: key.StringID(), Value: values[i]}
+		if errs != nil && errs[i] == datastore.ErrNoSuchEntity {
+			inc.Problem = MissingValue
+		} else if errs != nil && errs[i] != nil {
+			return nil, "", errs[i]
+		} else if idx.checkValue(valueKeys[i], values[i], props[i].full) != nil || props[i].token != "" || props[i].id != inc.Id {
+			inc.Problem = DuplicateValue
+		} else {
+			continue
+		}
+		found = append(found, inc)
+	}
+	return found, next, nil
+}
+
+// Check the index entities of (up to) `limit` values (only needed if old
+// values aren't saved).
+func (idx Index) verifyValues(ctx appengine.Context, cursor string, limit int) ([]Inconsistency, string, error) {
+	keys, ids, fulls, next, err := idx.list(ctx, valueEntity, "", cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Read the current value of each id
+	idKeys := make([]*datastore.Key, len(keys))
+	for i, id := range ids {
+		idKeys[i] = idx.newKey(ctx, idEntity, id)
+	}
+	canonical, err := getMulti(ctx, idKeys)
+	if err := dsutil.IgnoreMissing(err); err != nil {
+		return nil, "", err
+	}
+
+	var found []Inconsistency
+	for i, key := range keys {
+		value := key.StringID()
+		if fulls[i] != "" {
+			value = fulls[i]
+		}
+		if canonical[i] == "" || !idx.valueKey(ctx, canonical[i]).Equal(key) {
+			found = append(found, Inconsistency{Problem: StaleValue, Id: ids[i], Value: value})
+		}
+	}
+	return found, next, nil
+}
+
+// Fix an inconsistency in the current transaction if it is still present,
+// reporting whether it was (see set for `written`). inc.Fixed is set if it
+// was fixed.
+func (idx Index) fix(ctx appengine.Context, inc *Inconsistency, written map[string]bool) (bool, error) {
+	idKey := idx.newKey(ctx, idEntity, inc.Id)
+	valueKey := idx.valueKey(ctx, inc.Value)
+	if inc.Problem == StaleValue {
+		// The value is in the form used by its key, which may be from before
+		// a Normalizer was added
+		valueKey = idx.newKey(ctx, valueEntity, idx.keyName(inc.Value))
+	}
+	if written[idKey.String()] || written[valueKey.String()] {
+		return false, errBatchFull
+	}
+
+	// Read the current state of both sides
+	current, err := get(ctx, idKey)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+	var props *valueProps
+	if inc.Problem == StaleValue {
+		props = new(valueProps)
+		err = datastore.Get(ctx, valueKey, props)
+	} else {
+		props, err = idx.loadValue(ctx, valueKey, inc.Value)
+	}
+	if err == ErrHashCollision {
+		return true, nil // needs to be fixed by hand
+	} else if err != nil && err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+	missing := err == datastore.ErrNoSuchEntity
+
+	if inc.Problem == MissingValue && !missing && (props.id != inc.Id || props.token != "") {
+		// Another id got the value since it was checked (for example from an
+		// earlier fix, if a new Normalizer maps both values to the same form)
+		inc.Problem = DuplicateValue
+	}
+
+	switch inc.Problem {
+	case MissingValue:
+		if current != inc.Value || !missing {
+			return false, nil
+		}
+		written[valueKey.String()] = true
+		inc.Fixed = true
+		return true, idx.putId(ctx, valueKey, inc.Value, inc.Id)
+
+	case DuplicateValue:
+		if current != inc.Value || missing || (props.id == inc.Id && props.token == "") {
+			return false, nil
+		}
+
+		// Does the value belong to the other id?
+		if props.token == "" {
+			otherKey := idx.newKey(ctx, idEntity, props.id)
+			if written[otherKey.String()] {
+				return false, errBatchFull
+			}
+			other, err := get(ctx, otherKey)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return false, err
+			}
+			if err == nil && idx.valueKey(ctx, other).Equal(valueKey) {
+				return true, nil // needs to be fixed by hand
+			}
+		}
+
+		// It doesn't, so give it to this id
+		written[valueKey.String()] = true
+		inc.Fixed = true
+		return true, idx.putId(ctx, valueKey, inc.Value, inc.Id)
+
+	case StaleValue:
+		if missing || props.id != inc.Id || props.token != "" || (current != "" && idx.valueKey(ctx, current).Equal(valueKey)) {
+			return false, nil
+		}
+		written[valueKey.String()] = true
+		inc.Fixed = true
+		return true, datastore.Delete(ctx, valueKey)
+	}
+	return false, fmt.Errorf("unique: unknown problem %v", inc.Problem)
+}
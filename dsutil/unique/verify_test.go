@@ -0,0 +1,90 @@
+package unique
+
+import (
+	. "github.com/chippydip/gaege/testing"
+	. "launchpad.net/gocheck"
+)
+
+func (ctx *IndexSuite) putInconsistent(c *C) {
+	mapping := func(kind, name, prop string) Entity {
+		return Entity{"__key__": ctx.Key(kind, name), "$": prop}
+	}
+	ctx.PutAll(c,
+		mapping("TestI", "id1", "a"), // missing V
+		mapping("TestI", "id2", "b"), // b belongs to id3
+		mapping("TestI", "id3", "b"),
+		mapping("TestV", "b", "id3"),
+		mapping("TestI", "id4", "c"), // c is an old value of id5
+		mapping("TestV", "c", "id5"),
+		mapping("TestI", "id5", "z"),
+		mapping("TestV", "z", "id5"),
+		mapping("TestV", "s", "id6"), // id6 doesn't exist
+	)
+}
+
+func (ctx *IndexSuite) TestIndex_Verify(c *C) {
+	ctx.putInconsistent(c)
+	idx := NewIndex("Test", 0)
+
+	found, cursor, err := idx.Verify(ctx, "", 0)
+	c.Check(err, IsNil)
+	c.Check(found, DeepEquals, []Inconsistency{
+		{MissingValue, "id1", "a", false},
+		{DuplicateValue, "id2", "b", false},
+		{DuplicateValue, "id4", "c", false},
+	})
+	c.Assert(cursor, Equals, "V:")
+
+	found, cursor, err = idx.Verify(ctx, cursor, 0)
+	c.Check(err, IsNil)
+	c.Check(found, DeepEquals, []Inconsistency{
+		{StaleValue, "id5", "c", false},
+		{StaleValue, "id6", "s", false},
+	})
+	c.Check(cursor, Equals, "")
+
+	c.Check(ctx.GetAll(c), HasLen, 9) // nothing changed
+}
+
+func (ctx *IndexSuite) TestIndex_Repair(c *C) {
+	ctx.putInconsistent(c)
+	idx := NewIndex("Test", 0)
+
+	var repaired []Inconsistency
+	cursor := ""
+	for {
+		found, next, err := idx.Repair(ctx, cursor, 2)
+		c.Assert(err, IsNil)
+		repaired = append(repaired, found...)
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	c.Check(repaired, DeepEquals, []Inconsistency{
+		{MissingValue, "id1", "a", true},
+		{DuplicateValue, "id2", "b", false}, // both ids have it
+		{DuplicateValue, "id4", "c", true},
+		{StaleValue, "id6", "s", true},
+	})
+
+	// Everything is consistent now, except for the value that both ids have
+	var found []Inconsistency
+	for cursor = ""; ; {
+		more, next, err := idx.Verify(ctx, cursor, 0)
+		c.Assert(err, IsNil)
+		found = append(found, more...)
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	c.Check(found, DeepEquals, []Inconsistency{{DuplicateValue, "id2", "b", false}})
+
+	for value, expected := range map[string]string{"a": "id1", "b": "id3", "c": "id4", "z": "id5"} {
+		id, err := idx.GetId(ctx, value)
+		c.Check(err, IsNil)
+		c.Check(id, Equals, expected)
+	}
+	value, err := idx.GetValue(ctx, "id2")
+	c.Check(err, IsNil)
+	c.Check(value, Equals, "b")
+}